@@ -0,0 +1,462 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBrokenChain = errors.New("cache backup chain has unreadable deltas")
+)
+
+// Result describes a written full snapshot.
+type Result struct {
+	File    string `json:"file"`
+	Size    int64  `json:"size"`
+	Records int    `json:"records"`
+}
+
+// Manager periodically writes cache snapshots to cache.backup-dir. A full snapshot is
+// written every cache.backup-interval and, if cache.backup-delta-interval is set, deltas
+// with the keys changed since the previous snapshot are written in between. After
+// cache.backup-compact-after deltas the chain is merged into a new full snapshot.
+// Chains beyond the cache.backup-retention limits are removed.
+type Manager[K cache.Key[K], V cache.Codec[V]] struct {
+	mx            sync.Mutex
+	cache         *cache.Cache[K, V]
+	dir           string
+	fullInterval  time.Duration
+	deltaInterval time.Duration
+	compactAfter  int
+	retries       int
+	retryBackoff  time.Duration
+	keepLast      int
+	maxAge        time.Duration
+	maxBytes      int64
+	// base is the creation time of the full snapshot deltas are written on top of, zero if there is none.
+	base   int64
+	deltas []int64
+	stop   chan struct{}
+
+	metrics *metrics
+}
+
+func NewManager[K cache.Key[K], V cache.Codec[V]](c *cache.Cache[K, V], reg prometheus.Registerer) *Manager[K, V] {
+	m := &Manager[K, V]{
+		cache:         c,
+		dir:           viper.GetString("cache.backup-dir"),
+		fullInterval:  viper.GetDuration("cache.backup-interval"),
+		deltaInterval: viper.GetDuration("cache.backup-delta-interval"),
+		compactAfter:  viper.GetInt("cache.backup-compact-after"),
+		retries:       viper.GetInt("cache.backup-retries"),
+		retryBackoff:  viper.GetDuration("cache.backup-retry-backoff"),
+		keepLast:      viper.GetInt("cache.backup-retention.keep-last"),
+		maxAge:        viper.GetDuration("cache.backup-retention.max-age"),
+		maxBytes:      int64(viper.GetSizeInBytes("cache.backup-retention.max-bytes")),
+		stop:          make(chan struct{}),
+
+		metrics: newMetrics(reg),
+	}
+
+	if m.deltaInterval > 0 {
+		c.TrackChanges()
+	}
+
+	err := os.MkdirAll(m.dir, 0o755)
+	if err != nil {
+		logrus.Errorf("failed to create cache backup directory, error: %v", err)
+	}
+
+	err = removeTmpFiles(m.dir)
+	if err != nil {
+		logrus.Warnf("failed to remove unfinished cache backups, error: %v", err)
+	}
+
+	return m
+}
+
+func (m *Manager[K, V]) Start() {
+	interval := m.deltaInterval
+	if interval <= 0 {
+		interval = m.fullInterval
+	}
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := m.backupWithRetries()
+				if err != nil {
+					logrus.Errorf("failed to backup cache, error: %v", err)
+				}
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Shutdown stops periodic backups and writes a final full snapshot. It returns ctx.Err()
+// if the snapshot is not written before ctx is done; the write itself keeps going.
+func (m *Manager[K, V]) Shutdown(ctx context.Context) (Result, error) {
+	close(m.stop)
+
+	type snapshot struct {
+		res Result
+		err error
+	}
+
+	done := make(chan snapshot, 1)
+	go func() {
+		res, err := m.Snapshot()
+		done <- snapshot{res: res, err: err}
+	}()
+
+	select {
+	case s := <-done:
+		return s.res, s.err
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	}
+}
+
+// Snapshot writes a full snapshot regardless of the backup schedule and starts a new chain on it.
+func (m *Manager[K, V]) Snapshot() (Result, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	res, err := m.writeFull()
+	if err != nil {
+		m.metrics.failures.Inc()
+		return Result{}, err
+	}
+
+	m.prune()
+	return res, nil
+}
+
+// backupWithRetries retries a failed Backup cache.backup-retries times, doubling the pause between attempts.
+func (m *Manager[K, V]) backupWithRetries() error {
+	backoff := m.retryBackoff
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = m.Backup()
+		if err == nil || attempt >= m.retries {
+			return err
+		}
+
+		logrus.Warnf("failed to backup cache, retrying in %v, error: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Backup writes a delta, or a full snapshot when one is due, compacts the chain when it gets too long
+// and removes chains beyond retention.
+func (m *Manager[K, V]) Backup() error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	err := m.backup()
+	if err != nil {
+		m.metrics.failures.Inc()
+		return err
+	}
+
+	m.prune()
+	return nil
+}
+
+func (m *Manager[K, V]) backup() error {
+	if m.base == 0 || m.deltaInterval <= 0 || time.Since(time.Unix(0, m.base)) >= m.fullInterval {
+		_, err := m.writeFull()
+		return err
+	}
+
+	err := m.writeDelta()
+	if err != nil {
+		return err
+	}
+
+	if m.compactAfter > 0 && len(m.deltas) >= m.compactAfter {
+		return m.compact()
+	}
+
+	return nil
+}
+
+func (m *Manager[K, V]) writeFull() (Result, error) {
+	createdAt := time.Now().UnixNano()
+	filename := fullFileName(m.dir, createdAt)
+
+	count, size, err := writeFile(filename, m.cache.WriteSnapshot)
+	if err != nil {
+		m.base = 0
+		return Result{}, err
+	}
+
+	m.base = createdAt
+	m.deltas = nil
+	m.observe(kindFull, size)
+	return Result{File: filename, Size: size, Records: count}, nil
+}
+
+func (m *Manager[K, V]) writeDelta() error {
+	createdAt := time.Now().UnixNano()
+
+	_, size, err := writeFile(deltaFileName(m.dir, m.base, createdAt), m.cache.WriteDelta)
+	if err != nil {
+		// Changes written to the failed delta are no longer tracked, only a full snapshot has them.
+		m.base = 0
+		return err
+	}
+
+	m.deltas = append(m.deltas, createdAt)
+	m.observe(kindDelta, size)
+	return nil
+}
+
+func (m *Manager[K, V]) observe(kind string, size int64) {
+	m.metrics.lastSuccess.WithLabelValues(kind).Set(float64(time.Now().Unix()))
+	m.metrics.lastSize.WithLabelValues(kind).Set(float64(size))
+}
+
+// compact merges the current chain into a full snapshot named after its last delta and removes the chain files.
+func (m *Manager[K, V]) compact() error {
+	c := chain{base: m.base, deltas: m.deltas}
+
+	data, applied, err := readChain[K, V](m.dir, c)
+	if err != nil {
+		return err
+	}
+	if applied != len(c.deltas) {
+		return ErrBrokenChain
+	}
+
+	createdAt := c.deltas[len(c.deltas)-1]
+	_, size, err := writeFile(fullFileName(m.dir, createdAt), func(w io.Writer) (int, error) {
+		enc, err := cache.NewEncoder[K, V](w)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, item := range data {
+			err = enc.Encode(item)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return enc.Count(), enc.Close()
+	})
+	if err != nil {
+		return err
+	}
+
+	m.base = createdAt
+	m.deltas = nil
+	m.observe(kindFull, size)
+
+	removeFiles(c.files(m.dir))
+	return nil
+}
+
+// prune removes chains older than the newest one once they exceed cache.backup-retention:
+// more than keep-last chains, files older than max-age or more than max-bytes in total.
+func (m *Manager[K, V]) prune() {
+	chains, err := listChains(m.dir)
+	if err != nil {
+		logrus.Warnf("failed to list cache backups for retention, error: %v", err)
+		return
+	}
+
+	var total int64
+	for i, c := range chains {
+		total += c.size(m.dir)
+		if i == 0 {
+			continue
+		}
+
+		if (m.keepLast > 0 && i >= m.keepLast) ||
+			(m.maxAge > 0 && time.Since(c.createdAt()) > m.maxAge) ||
+			(m.maxBytes > 0 && total > m.maxBytes) {
+			removeFiles(c.files(m.dir))
+		}
+	}
+}
+
+// Restore loads the newest readable chain into the cache. A chain whose full snapshot
+// is broken is skipped, a broken delta ends the chain at the previous one.
+func (m *Manager[K, V]) Restore() (int, error) {
+	chains, err := listChains(m.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, c := range chains {
+		data, applied, err := readChain[K, V](m.dir, c)
+		if err != nil {
+			logrus.Warnf("failed to restore cache from %s, error: %v", fullFileName(m.dir, c.base), err)
+			continue
+		}
+
+		m.cache.Apply(data)
+		m.metrics.restoredKeys.Set(float64(len(data)))
+		logrus.Infof("restored %d keys to cache from %s and %d of %d deltas", len(data), fullFileName(m.dir, c.base), applied, len(c.deltas))
+		return len(data), nil
+	}
+
+	logrus.Info("no valid cache backup found, starting with empty cache")
+	return 0, nil
+}
+
+// readChain replays the deltas of c over its full snapshot and returns the resulting entries
+// and the number of deltas applied.
+func readChain[K cache.Key[K], V cache.Codec[V]](dir string, c chain) ([]cache.Data[K, V], int, error) {
+	base, err := readFile[K, V](fullFileName(dir, c.base))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	merged := make(map[K]V, len(base))
+	for _, item := range base {
+		merged[item.Key] = item.Value
+	}
+
+	applied := 0
+	for _, createdAt := range c.deltas {
+		delta, err := readFile[K, V](deltaFileName(dir, c.base, createdAt))
+		if err != nil {
+			logrus.Warnf("failed to read cache delta %s, error: %v", deltaFileName(dir, c.base, createdAt), err)
+			break
+		}
+
+		for _, item := range delta {
+			if item.Deleted {
+				delete(merged, item.Key)
+				continue
+			}
+			merged[item.Key] = item.Value
+		}
+		applied++
+	}
+
+	data := make([]cache.Data[K, V], 0, len(merged))
+	for key, value := range merged {
+		data = append(data, cache.Data[K, V]{Key: key, Value: value})
+	}
+
+	return data, applied, nil
+}
+
+func readFile[K cache.Key[K], V cache.Codec[V]](filename string) ([]cache.Data[K, V], error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = gzipReader.Close() }()
+
+	dec, err := cache.NewDecoder[K, V](bufio.NewReader(gzipReader))
+	if err != nil {
+		return nil, err
+	}
+
+	var data []cache.Data[K, V]
+	for {
+		item, err := dec.Decode()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return data, nil
+			}
+			return nil, err
+		}
+		data = append(data, item)
+	}
+}
+
+// writeFile writes a gzip compressed snapshot produced by write to a temporary file and
+// renames it to filename once it is synced, so filename is either complete or missing.
+// It returns the number of records and the size of the file.
+func writeFile(filename string, write func(w io.Writer) (int, error)) (int, int64, error) {
+	tmpFilename := filename + tmpFileSuffix
+
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	gzipWriter := gzip.NewWriter(file)
+	bufWriter := bufio.NewWriter(gzipWriter)
+
+	count, err := write(bufWriter)
+	if err == nil {
+		err = bufWriter.Flush()
+	}
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+
+	var size int64
+	if err == nil {
+		var info os.FileInfo
+		info, err = file.Stat()
+		if err == nil {
+			size = info.Size()
+		}
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFilename)
+		return 0, 0, err
+	}
+
+	err = syncDir(filepath.Dir(filename))
+	if err != nil {
+		logrus.Warnf("failed to sync cache backup directory, error: %v", err)
+	}
+
+	return count, size, nil
+}
+
+func removeFiles(filenames []string) {
+	for _, filename := range filenames {
+		err := os.Remove(filename)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("failed to remove cache backup %s, error: %v", filename, err)
+		}
+	}
+}
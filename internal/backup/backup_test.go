@@ -0,0 +1,369 @@
+package backup
+
+import (
+	"errors"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type data = cache.Data[cache.Int, cache.ByteSlc]
+
+// newTestManager creates a manager backing up a new cache to a temporary directory.
+func newTestManager(t *testing.T, overrides map[string]any) (*Manager[cache.Int, cache.ByteSlc], *cache.Cache[cache.Int, cache.ByteSlc]) {
+	t.Helper()
+
+	viper.Reset()
+	viper.Set("cache.elems.threshold", 1_000_000)
+	viper.Set("cache.elems.remains-after-clean", 1_000)
+	viper.Set("cache.buckets-amount", 4)
+	viper.Set("cache.backup-dir", t.TempDir())
+	viper.Set("cache.backup-interval", time.Hour)
+	viper.Set("cache.backup-delta-interval", time.Minute)
+	for key, value := range overrides {
+		viper.Set(key, value)
+	}
+
+	reg := prometheus.NewRegistry()
+	c := cache.NewCache[cache.Int, cache.ByteSlc](t.Name(), reg)
+	return NewManager(c, reg), c
+}
+
+// writeTestFile writes records to filename in the backup format.
+func writeTestFile(t *testing.T, filename string, records ...data) {
+	t.Helper()
+
+	_, _, err := writeFile(filename, func(w io.Writer) (int, error) {
+		enc, err := cache.NewEncoder[cache.Int, cache.ByteSlc](w)
+		if err != nil {
+			return 0, err
+		}
+		for _, record := range records {
+			err = enc.Encode(record)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return enc.Count(), enc.Close()
+	})
+	if err != nil {
+		t.Fatalf("failed to write %s, error: %v", filename, err)
+	}
+}
+
+func readValues(t *testing.T, filename string) map[cache.Int]string {
+	t.Helper()
+
+	records, err := readFile[cache.Int, cache.ByteSlc](filename)
+	if err != nil {
+		t.Fatalf("failed to read %s, error: %v", filename, err)
+	}
+
+	values := make(map[cache.Int]string, len(records))
+	for _, record := range records {
+		values[record.Key] = string(record.Value)
+	}
+	return values
+}
+
+func cacheValues(c *cache.Cache[cache.Int, cache.ByteSlc]) map[cache.Int]string {
+	values := make(map[cache.Int]string)
+	c.Range(func(key cache.Int, value cache.ByteSlc) bool {
+		values[key] = string(value)
+		return true
+	})
+	return values
+}
+
+func equalValues(a, b map[cache.Int]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRestoreReplaysChain(t *testing.T) {
+	m, c := newTestManager(t, nil)
+
+	const base = 1_000
+	writeTestFile(t, fullFileName(m.dir, base),
+		data{Key: 1, Value: cache.ByteSlc("1")},
+		data{Key: 2, Value: cache.ByteSlc("2")},
+		data{Key: 3, Value: cache.ByteSlc("3")},
+	)
+	writeTestFile(t, deltaFileName(m.dir, base, base+1),
+		data{Key: 2, Value: cache.ByteSlc("2 updated")},
+		data{Key: 3, Deleted: true},
+		data{Key: 4, Value: cache.ByteSlc("4")},
+	)
+	writeTestFile(t, deltaFileName(m.dir, base, base+2),
+		data{Key: 1, Deleted: true},
+		data{Key: 3, Value: cache.ByteSlc("3 again")},
+	)
+	// A delta that fails to decode ends the chain at the previous one.
+	err := os.WriteFile(deltaFileName(m.dir, base, base+3), []byte("broken"), 0o644)
+	if err != nil {
+		t.Fatalf("failed to write broken delta, error: %v", err)
+	}
+	writeTestFile(t, deltaFileName(m.dir, base, base+4), data{Key: 5, Value: cache.ByteSlc("5")})
+
+	n, err := m.Restore()
+	if err != nil {
+		t.Fatalf("failed to restore, error: %v", err)
+	}
+
+	want := map[cache.Int]string{2: "2 updated", 3: "3 again", 4: "4"}
+	if got := cacheValues(c); n != len(want) || !equalValues(got, want) {
+		t.Errorf("restored %d keys %v, want %v", n, got, want)
+	}
+}
+
+func TestRestoreSkipsBrokenFullSnapshot(t *testing.T) {
+	m, c := newTestManager(t, nil)
+
+	writeTestFile(t, fullFileName(m.dir, 1_000), data{Key: 1, Value: cache.ByteSlc("older")})
+	err := os.WriteFile(fullFileName(m.dir, 2_000), []byte("broken"), 0o644)
+	if err != nil {
+		t.Fatalf("failed to write broken snapshot, error: %v", err)
+	}
+
+	_, err = m.Restore()
+	if err != nil {
+		t.Fatalf("failed to restore, error: %v", err)
+	}
+	if got := cacheValues(c); !equalValues(got, map[cache.Int]string{1: "older"}) {
+		t.Errorf("restored %v, want the older chain", got)
+	}
+}
+
+func TestBackupCompactsChain(t *testing.T) {
+	m, c := newTestManager(t, map[string]any{"cache.backup-compact-after": 2})
+
+	c.PutKey(1, cache.ByteSlc("1"))
+	c.PutKey(2, cache.ByteSlc("2"))
+	mustBackup(t, m)
+
+	c.PutKey(2, cache.ByteSlc("2 updated"))
+	c.PutKey(3, cache.ByteSlc("3"))
+	mustBackup(t, m)
+
+	c.Delete(1)
+	mustBackup(t, m)
+
+	chains, err := listChains(m.dir)
+	if err != nil {
+		t.Fatalf("failed to list chains, error: %v", err)
+	}
+	if len(chains) != 1 || len(chains[0].deltas) != 0 {
+		t.Fatalf("got chains %v, want one compacted full snapshot", chains)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(m.dir, "*"))
+	if len(files) != 1 {
+		t.Errorf("backup directory holds %v, want the compacted snapshot only", files)
+	}
+
+	want := map[cache.Int]string{2: "2 updated", 3: "3"}
+	if got := readValues(t, fullFileName(m.dir, chains[0].base)); !equalValues(got, want) {
+		t.Errorf("compacted snapshot holds %v, want %v", got, want)
+	}
+
+	// Deltas are written on top of the compacted snapshot.
+	c.PutKey(4, cache.ByteSlc("4"))
+	mustBackup(t, m)
+	chains, _ = listChains(m.dir)
+	if len(chains) != 1 || len(chains[0].deltas) != 1 {
+		t.Errorf("got chains %v, want a delta on the compacted snapshot", chains)
+	}
+}
+
+func mustBackup(t *testing.T, m *Manager[cache.Int, cache.ByteSlc]) {
+	t.Helper()
+
+	err := m.Backup()
+	if err != nil {
+		t.Fatalf("failed to backup, error: %v", err)
+	}
+}
+
+func TestBackupFailureFallsBackToFullSnapshot(t *testing.T) {
+	m, c := newTestManager(t, map[string]any{
+		"cache.backup-retries":       2,
+		"cache.backup-retry-backoff": time.Millisecond,
+	})
+
+	c.PutKey(1, cache.ByteSlc("1"))
+	mustBackup(t, m)
+
+	// The changes tracked for the delta are lost with the failed writes.
+	c.PutKey(2, cache.ByteSlc("2"))
+	err := os.RemoveAll(m.dir)
+	if err != nil {
+		t.Fatalf("failed to remove backup directory, error: %v", err)
+	}
+	if err = m.backupWithRetries(); err == nil {
+		t.Fatalf("backup to a missing directory succeeded")
+	}
+
+	err = os.MkdirAll(m.dir, 0o755)
+	if err != nil {
+		t.Fatalf("failed to create backup directory, error: %v", err)
+	}
+	mustBackup(t, m)
+
+	chains, _ := listChains(m.dir)
+	if len(chains) != 1 || len(chains[0].deltas) != 0 {
+		t.Fatalf("got chains %v, want a full snapshot after the failure", chains)
+	}
+	if got := readValues(t, fullFileName(m.dir, chains[0].base)); !equalValues(got, map[cache.Int]string{1: "1", 2: "2"}) {
+		t.Errorf("snapshot after the failure holds %v", got)
+	}
+}
+
+func TestPruneRetention(t *testing.T) {
+	now := time.Now()
+	hoursAgo := func(h int) int64 { return now.Add(-time.Duration(h) * time.Hour).UnixNano() }
+
+	tests := []struct {
+		name      string
+		overrides map[string]any
+		// want lists the bases of the chains kept, newest first.
+		want []int64
+	}{
+		{
+			name:      "keep last",
+			overrides: map[string]any{"cache.backup-retention.keep-last": 2},
+			want:      []int64{hoursAgo(1), hoursAgo(2)},
+		},
+		{
+			name:      "max age",
+			overrides: map[string]any{"cache.backup-retention.max-age": 150 * time.Minute},
+			want:      []int64{hoursAgo(1), hoursAgo(2)},
+		},
+		{
+			name:      "max age keeps the newest chain",
+			overrides: map[string]any{"cache.backup-retention.max-age": time.Minute},
+			want:      []int64{hoursAgo(1)},
+		},
+		{
+			name:      "no limits",
+			overrides: nil,
+			want:      []int64{hoursAgo(1), hoursAgo(2), hoursAgo(3), hoursAgo(4)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestManager(t, tt.overrides)
+			for h := 1; h <= 4; h++ {
+				writeTestFile(t, fullFileName(m.dir, hoursAgo(h)), data{Key: cache.Int(h), Value: cache.ByteSlc(strconv.Itoa(h))})
+			}
+			// The deltas of a chain go with it.
+			writeTestFile(t, deltaFileName(m.dir, hoursAgo(4), hoursAgo(4)+1), data{Key: 4, Deleted: true})
+
+			m.prune()
+			assertChains(t, m.dir, tt.want)
+		})
+	}
+}
+
+func TestPruneMaxBytes(t *testing.T) {
+	m, _ := newTestManager(t, nil)
+
+	var size int64
+	for base := int64(1); base <= 4; base++ {
+		writeTestFile(t, fullFileName(m.dir, base), data{Key: cache.Int(base), Value: cache.ByteSlc("value")})
+		info, err := os.Stat(fullFileName(m.dir, base))
+		if err != nil {
+			t.Fatalf("failed to stat backup, error: %v", err)
+		}
+		size = info.Size()
+	}
+
+	m.maxBytes = 2*size + size/2
+	m.prune()
+	assertChains(t, m.dir, []int64{4, 3})
+
+	// The newest chain is kept even if it is larger than the limit.
+	m.maxBytes = 1
+	m.prune()
+	assertChains(t, m.dir, []int64{4})
+}
+
+func assertChains(t *testing.T, dir string, want []int64) {
+	t.Helper()
+
+	chains, err := listChains(dir)
+	if err != nil {
+		t.Fatalf("failed to list chains, error: %v", err)
+	}
+
+	got := make([]int64, len(chains))
+	for i, c := range chains {
+		got[i] = c.base
+	}
+	if len(got) != len(want) {
+		t.Fatalf("kept chains %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("kept chains %v, want %v", got, want)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, deltaFilePrefix+"*"))
+	for _, file := range files {
+		var kept bool
+		for _, c := range chains {
+			for _, createdAt := range c.deltas {
+				kept = kept || file == deltaFileName(dir, c.base, createdAt)
+			}
+		}
+		if !kept {
+			t.Errorf("delta %s of a removed chain is left", file)
+		}
+	}
+}
+
+func TestWriteFileIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "snapshot.gz")
+
+	failure := errors.New("write failed")
+	_, _, err := writeFile(filename, func(w io.Writer) (int, error) {
+		_, _ = w.Write([]byte("partial"))
+		return 0, failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("failed write returned %v, want %v", err, failure)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("failed write left %v", files)
+	}
+
+	writeTestFile(t, filename, data{Key: 1, Value: cache.ByteSlc("1")})
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 || files[0] != filename {
+		t.Errorf("write left %v, want %s only", files, filename)
+	}
+
+	// Temporary files of a write interrupted by a crash are removed on start.
+	err = os.WriteFile(filename+tmpFileSuffix, []byte("partial"), 0o644)
+	if err != nil {
+		t.Fatalf("failed to write temporary file, error: %v", err)
+	}
+	newTestManager(t, map[string]any{"cache.backup-dir": dir})
+	if _, err = os.Stat(filename + tmpFileSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary file was not removed, error: %v", err)
+	}
+}
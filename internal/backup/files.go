@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fullFilePrefix   = "cache_data_"
+	deltaFilePrefix  = "cache_delta_"
+	backupFileSuffix = ".gz"
+	tmpFileSuffix    = ".tmp"
+)
+
+// chain is a full snapshot and the deltas written on top of it, both identified by
+// their creation time in unix nanoseconds.
+type chain struct {
+	base   int64
+	deltas []int64
+}
+
+// createdAt returns the creation time of the newest file of the chain.
+func (c chain) createdAt() time.Time {
+	if len(c.deltas) == 0 {
+		return time.Unix(0, c.base)
+	}
+	return time.Unix(0, c.deltas[len(c.deltas)-1])
+}
+
+func (c chain) files(dir string) []string {
+	files := make([]string, 0, len(c.deltas)+1)
+	files = append(files, fullFileName(dir, c.base))
+	for _, createdAt := range c.deltas {
+		files = append(files, deltaFileName(dir, c.base, createdAt))
+	}
+	return files
+}
+
+// size returns the total size of the chain files, missing files are skipped.
+func (c chain) size(dir string) int64 {
+	var size int64
+	for _, filename := range c.files(dir) {
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		size += info.Size()
+	}
+	return size
+}
+
+func fullFileName(dir string, base int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d%s", fullFilePrefix, base, backupFileSuffix))
+}
+
+func deltaFileName(dir string, base, createdAt int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d_%d%s", deltaFilePrefix, base, createdAt, backupFileSuffix))
+}
+
+// listChains returns the chains found in dir, newest base first, deltas oldest first.
+func listChains(dir string) ([]chain, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	deltas := make(map[int64][]int64)
+	var bases []int64
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, backupFileSuffix) {
+			continue
+		}
+		name = strings.TrimSuffix(name, backupFileSuffix)
+
+		switch {
+		case strings.HasPrefix(name, fullFilePrefix):
+			base, err := strconv.ParseInt(strings.TrimPrefix(name, fullFilePrefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			bases = append(bases, base)
+
+		case strings.HasPrefix(name, deltaFilePrefix):
+			rawBase, rawCreatedAt, ok := strings.Cut(strings.TrimPrefix(name, deltaFilePrefix), "_")
+			if !ok {
+				continue
+			}
+
+			base, err := strconv.ParseInt(rawBase, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			createdAt, err := strconv.ParseInt(rawCreatedAt, 10, 64)
+			if err != nil {
+				continue
+			}
+			deltas[base] = append(deltas[base], createdAt)
+		}
+	}
+
+	sort.Slice(bases, func(i, j int) bool {
+		return bases[i] > bases[j]
+	})
+
+	chains := make([]chain, 0, len(bases))
+	for _, base := range bases {
+		d := deltas[base]
+		sort.Slice(d, func(i, j int) bool {
+			return d[i] < d[j]
+		})
+		chains = append(chains, chain{base: base, deltas: d})
+	}
+
+	return chains, nil
+}
+
+// removeTmpFiles removes files left by writes interrupted by a crash.
+func removeTmpFiles(dir string) error {
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*"+tmpFileSuffix))
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range tmpFiles {
+		err = os.Remove(filename)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+
+	return d.Sync()
+}
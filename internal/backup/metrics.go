@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	kindFull  = "full"
+	kindDelta = "delta"
+)
+
+type metrics struct {
+	restoredKeys prometheus.Gauge
+	lastSuccess  *prometheus.GaugeVec
+	lastSize     *prometheus.GaugeVec
+	failures     prometheus.Counter
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		restoredKeys: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "TestTaskNatsApp",
+				Name:      "cache_restored_keys",
+				Help:      "number of keys restored from cache backup on start",
+			}),
+
+		lastSuccess: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "TestTaskNatsApp",
+				Name:      "cache_backup_last_success_timestamp_seconds",
+				Help:      "unix time of the last successful cache backup",
+			}, []string{"kind"}),
+
+		lastSize: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "TestTaskNatsApp",
+				Name:      "cache_backup_last_size_bytes",
+				Help:      "size of the last successful cache backup file",
+			}, []string{"kind"}),
+
+		failures: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "TestTaskNatsApp",
+				Name:      "cache_backup_failures_total",
+				Help:      "number of failed cache backup attempts",
+			}),
+	}
+
+	reg.MustRegister(m.restoredKeys, m.lastSuccess, m.lastSize, m.failures)
+	return m
+}
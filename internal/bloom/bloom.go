@@ -0,0 +1,86 @@
+package bloom
+
+import (
+	"math"
+	"sync"
+)
+
+// Filter is a Bloom filter of uint64 keys. MayContain never reports an added key as absent,
+// it reports an absent key as present with about the false positive rate the filter was
+// sized for. Keys cannot be removed, so a deleted key keeps being reported as present.
+type Filter struct {
+	mx     sync.RWMutex
+	bits   []uint64
+	size   uint64
+	hashes int
+	keys   int
+}
+
+// NewFilter creates a filter that holds capacity keys with falsePositiveRate.
+func NewFilter(capacity int, falsePositiveRate float64) *Filter {
+	capacity = max(capacity, 1)
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+
+	size := math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := math.Round(size / float64(capacity) * math.Ln2)
+
+	return &Filter{
+		bits:   make([]uint64, (int(size)+63)/64),
+		size:   uint64(size),
+		hashes: max(int(hashes), 1),
+	}
+}
+
+func (f *Filter) Add(key uint64) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	h1, h2 := hash(key)
+	for i := 0; i < f.hashes; i++ {
+		bit := f.bit(h1, h2, i)
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.keys++
+}
+
+func (f *Filter) MayContain(key uint64) bool {
+	f.mx.RLock()
+	defer f.mx.RUnlock()
+
+	h1, h2 := hash(key)
+	for i := 0; i < f.hashes; i++ {
+		bit := f.bit(h1, h2, i)
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of added keys, counting repeated adds of a key.
+func (f *Filter) Len() int {
+	f.mx.RLock()
+	defer f.mx.RUnlock()
+	return f.keys
+}
+
+func (f *Filter) bit(h1, h2 uint64, i int) uint64 {
+	return (h1 + uint64(i)*h2) % f.size
+}
+
+// hash derives the two hashes the filter positions are combined from.
+func hash(key uint64) (uint64, uint64) {
+	return mix(key), mix(key^0x9e3779b97f4a7c15) | 1
+}
+
+// mix is the splitmix64 finalizer.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
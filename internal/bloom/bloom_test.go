@@ -0,0 +1,85 @@
+package bloom
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	const (
+		capacity = 100_000
+		rate     = 0.01
+	)
+
+	f := NewFilter(capacity, rate)
+	for key := uint64(1); key <= capacity; key++ {
+		f.Add(key)
+	}
+
+	for key := uint64(1); key <= capacity; key++ {
+		if !f.MayContain(key) {
+			t.Fatalf("added key %d reported absent", key)
+		}
+	}
+
+	var positives int
+	for key := uint64(capacity + 1); key <= 11*capacity; key++ {
+		if f.MayContain(key) {
+			positives++
+		}
+	}
+	if got := float64(positives) / (10 * capacity); got > 1.5*rate {
+		t.Errorf("false positive rate is %.4f, want about %.4f", got, rate)
+	}
+}
+
+func TestGuardLoad(t *testing.T) {
+	g := NewGuard()
+	if !g.MayContain(1) {
+		t.Errorf("key reported absent before the filter was loaded")
+	}
+
+	// Keys 1 and 2 are listed, key 3 is added before the listing, key 4 while it is read
+	// and missing from it, as a row inserted by another instance during startup.
+	g.Add(3)
+	n, err := g.Load(func() ([]uint64, error) {
+		g.Add(4)
+		return []uint64{1, 2}, nil
+	}, 1000, 0.01)
+	if err != nil || n != 2 {
+		t.Fatalf("load returned %d, %v, want 2 keys", n, err)
+	}
+
+	g.Add(5)
+	for key := uint64(1); key <= 5; key++ {
+		if !g.MayContain(key) {
+			t.Errorf("key %d reported absent", key)
+		}
+	}
+
+	var positives int
+	for key := uint64(100); key < 10_100; key++ {
+		if g.MayContain(key) {
+			positives++
+		}
+	}
+	if positives > 150 {
+		t.Errorf("%d of 10000 absent keys reported present", positives)
+	}
+}
+
+func TestGuardLoadFailure(t *testing.T) {
+	g := NewGuard()
+
+	_, err := g.Load(func() ([]uint64, error) {
+		return nil, errors.New("table is unavailable")
+	}, 1000, 0.01)
+	if err == nil {
+		t.Fatalf("load of a failed listing succeeded")
+	}
+
+	g.Add(1)
+	if !g.MayContain(2) || len(g.pending) != 0 {
+		t.Errorf("guard does not report every key present after a failed load")
+	}
+}
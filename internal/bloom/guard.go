@@ -0,0 +1,75 @@
+package bloom
+
+import (
+	"sync"
+)
+
+// Guard is a filter built from a listing of every key, like the ids of a table, that
+// keeps being updated with added keys. Keys added before the filter is built are
+// buffered and added with the listing, so a key added while the listing is read is
+// never reported absent. Until the filter is built, or if listing fails, MayContain
+// reports every key as present.
+type Guard struct {
+	mx      sync.RWMutex
+	filter  *Filter
+	pending []uint64
+	// loading is set until Load returns, adds are buffered only then.
+	loading bool
+}
+
+func NewGuard() *Guard {
+	return &Guard{loading: true}
+}
+
+// Add adds key to the filter, or buffers it until the filter is built by Load.
+func (g *Guard) Add(key uint64) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	if g.filter != nil {
+		g.filter.Add(key)
+		return
+	}
+	if g.loading {
+		g.pending = append(g.pending, key)
+	}
+}
+
+// Load builds the filter from the keys returned by list and the keys added so far. The filter
+// is sized for capacity keys or twice the number of keys if that is more. Subscribe to
+// added keys before calling Load, keys added before that are not seen by the filter.
+func (g *Guard) Load(list func() ([]uint64, error), capacity int, falsePositiveRate float64) (int, error) {
+	keys, err := list()
+
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	g.loading = false
+	pending := g.pending
+	g.pending = nil
+	if err != nil {
+		return 0, err
+	}
+
+	filter := NewFilter(max(capacity, 2*(len(keys)+len(pending))), falsePositiveRate)
+	for _, key := range keys {
+		filter.Add(key)
+	}
+	for _, key := range pending {
+		filter.Add(key)
+	}
+	g.filter = filter
+
+	return len(keys), nil
+}
+
+// MayContain reports whether key may have been added, every key may have been until Load succeeds.
+func (g *Guard) MayContain(key uint64) bool {
+	g.mx.RLock()
+	defer g.mx.RUnlock()
+
+	if g.filter == nil {
+		return true
+	}
+	return g.filter.MayContain(key)
+}
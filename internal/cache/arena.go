@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"math"
+)
+
+const (
+	StorageMap   = "map"
+	StorageArena = "arena"
+
+	// Entry header in the arena: key length, value length.
+	arenaHeaderSize = 4 + 4
+)
+
+var (
+	ErrUnknownStorage   = errors.New("unknown cache storage")
+	ErrInvalidArenaSize = errors.New("cache arena size must be positive, check cache.max-bytes")
+)
+
+// arena is a ring of entries holding the marshalled values of a bucket, used with cache.storage
+// set to arena. Items of the bucket keep the offset of their entry instead of the value, so
+// the items map references no values and the garbage collector does not scan them however
+// many there are. Entries are appended at the tail, removed entries keep their space until
+// the head of the ring reaches them, see bucket.arenaAlloc.
+type arena struct {
+	data []byte
+	head int
+	tail int
+	// wrapAt is the end of the entries before the tail wrapped to the start, valid if wrapped is set.
+	wrapAt  int
+	wrapped bool
+	// stored counts entries in the ring, including the ones of removed items.
+	stored int
+}
+
+// arenaSizeFor splits maxBytes between buckets.
+func arenaSizeFor(maxBytes, bucketsAmount int) (int, error) {
+	if bucketsAmount <= 0 {
+		return 0, ErrInvalidArenaSize
+	}
+
+	size := min(maxBytes/bucketsAmount, math.MaxUint32)
+	if size <= arenaHeaderSize {
+		return 0, ErrInvalidArenaSize
+	}
+	return size, nil
+}
+
+func newArena(size int) *arena {
+	return &arena{data: make([]byte, size)}
+}
+
+// reserve returns the offset of size free bytes at the tail, false if they are taken by the entries from the head on.
+func (a *arena) reserve(size int) (int, bool) {
+	if a.stored == 0 {
+		a.head, a.tail, a.wrapped = 0, 0, false
+	}
+
+	if !a.wrapped && a.tail+size > len(a.data) {
+		a.wrapAt, a.tail, a.wrapped = a.tail, 0, true
+	}
+	if a.wrapped && a.tail+size > a.head {
+		return 0, false
+	}
+
+	offset := a.tail
+	a.tail += size
+	a.stored++
+	return offset, true
+}
+
+func (a *arena) write(offset int, rawByteKey, value []byte) {
+	entry := a.data[offset:]
+	binary.LittleEndian.PutUint32(entry[0:], uint32(len(rawByteKey)))
+	binary.LittleEndian.PutUint32(entry[4:], uint32(len(value)))
+	copy(entry[arenaHeaderSize:], rawByteKey)
+	copy(entry[arenaHeaderSize+len(rawByteKey):], value)
+}
+
+// entry returns the key and the value of the entry at offset, they share memory with the arena.
+func (a *arena) entry(offset int) ([]byte, []byte) {
+	entry := a.data[offset:]
+	keyLen := int(binary.LittleEndian.Uint32(entry[0:]))
+	valueLen := int(binary.LittleEndian.Uint32(entry[4:]))
+
+	key := entry[arenaHeaderSize : arenaHeaderSize+keyLen]
+	return key, entry[arenaHeaderSize+keyLen : arenaHeaderSize+keyLen+valueLen]
+}
+
+// dropHead removes the oldest entry of size bytes from the ring.
+func (a *arena) dropHead(size int) {
+	a.head += size
+	a.stored--
+	if a.wrapped && a.head == a.wrapAt {
+		a.head, a.wrapped = 0, false
+	}
+}
+
+func (a *arena) reset() {
+	a.head, a.tail, a.wrapped, a.stored = 0, 0, false, 0
+}
+
+// arenaStore moves the marshalled value of item into the arena and returns the item referencing it,
+// it must be called with c.mx held. An item larger than the arena is returned as is and not stored by insert.
+func (c *bucket[K, V]) arenaStore(key K, item Item[K, V]) Item[K, V] {
+	if item.packed == nil {
+		return item
+	}
+
+	rawByteKey, err := key.Marshal()
+	if err != nil {
+		logrus.Errorf("failed to marshal cache key for the arena, keeping the value on the heap, error: %v", err)
+		return item
+	}
+
+	item.size = arenaHeaderSize + len(rawByteKey) + len(item.packed)
+	if item.size > len(c.arena.data) {
+		return item
+	}
+
+	offset := c.arenaAlloc(item.size)
+	c.arena.write(offset, rawByteKey, item.packed)
+
+	item.offset, item.inArena, item.packed = uint32(offset), true, nil
+	return item
+}
+
+// arenaAlloc returns the offset of size free bytes in the arena, it must be called with c.mx held.
+// Items chosen by the eviction policy are evicted until the live entries and the new one fit
+// into the arena. Then space is reclaimed from the head of the ring: entries of removed items
+// are dropped and live ones are moved to the tail. A live entry that has no room at the tail,
+// or is reached again after every entry was moved once, is evicted instead.
+func (c *bucket[K, V]) arenaAlloc(size int) int {
+	for c.bytes+size > len(c.arena.data) && c.evictOne() {
+	}
+
+	moves := c.arena.stored
+	for {
+		offset, ok := c.arena.reserve(size)
+		if ok {
+			return offset
+		}
+
+		if c.reclaimHead(moves > 0) {
+			moves--
+		}
+	}
+}
+
+// reclaimHead drops the oldest entry of the arena, moving it to the tail if it is live and move is set.
+// It reports whether the entry was moved.
+func (c *bucket[K, V]) reclaimHead(move bool) bool {
+	a := c.arena
+	offset := a.head
+	rawByteKey, value := a.entry(offset)
+	size := arenaHeaderSize + len(rawByteKey) + len(value)
+
+	key, item, live := c.arenaOwner(offset, rawByteKey)
+	a.dropHead(size)
+	if !live {
+		return false
+	}
+
+	if move {
+		if to, ok := a.reserve(size); ok {
+			copy(a.data[to:to+size], a.data[offset:offset+size])
+			item.offset = uint32(to)
+			c.items[key] = item
+			return true
+		}
+	}
+
+	// The entry is out of the ring but its bytes are intact until the next reserve,
+	// so the hooks still get the value.
+	c.removeItem(key, item, ReasonCapacity)
+	return false
+}
+
+// arenaOwner returns the item whose entry is at offset, false if the entry belongs to a removed item.
+func (c *bucket[K, V]) arenaOwner(offset int, rawByteKey []byte) (K, Item[K, V], bool) {
+	var zero K
+	key, err := zero.Unmarshal(rawByteKey)
+	if err != nil {
+		return key, Item[K, V]{}, false
+	}
+
+	item, ok := c.items[key]
+	return key, item, ok && item.inArena && int(item.offset) == offset
+}
+
+// detach returns item with its value copied out of the arena, so it can be used after c.mx
+// is released. It must be called with c.mx held.
+func (c *bucket[K, V]) detach(item Item[K, V]) Item[K, V] {
+	if !item.inArena {
+		return item
+	}
+
+	_, value := c.arena.entry(int(item.offset))
+	item.packed = append([]byte(nil), value...)
+	item.inArena = false
+	return item
+}
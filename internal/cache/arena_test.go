@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func newTestArenaCache(t testing.TB, maxBytes string, overrides map[string]any) *Cache[Int, ByteSlc] {
+	t.Helper()
+
+	settings := map[string]any{
+		"cache.storage":        StorageArena,
+		"cache.buckets-amount": 4,
+		"cache.max-bytes":      maxBytes,
+	}
+	for key, value := range overrides {
+		settings[key] = value
+	}
+	return newTestCache[Int, ByteSlc](t, settings)
+}
+
+func TestArenaStorageSize(t *testing.T) {
+	for _, maxBytes := range []string{"", "0", "16"} {
+		c := newTestArenaCache(t, maxBytes, nil)
+		if c.arenas {
+			t.Errorf("max bytes %q created arenas", maxBytes)
+		}
+	}
+
+	c := newTestArenaCache(t, "4KB", nil)
+	if !c.arenas {
+		t.Fatalf("arena storage was not used")
+	}
+
+	c.PutKey(1, make(ByteSlc, 100))
+	if _, ok := c.Get(1); !ok {
+		t.Errorf("value that fits into an arena is not cached")
+	}
+
+	c.PutKey(1, make(ByteSlc, 1024))
+	if _, ok := c.Get(1); ok {
+		t.Errorf("value larger than an arena is cached")
+	}
+}
+
+func TestArenaStorage(t *testing.T) {
+	c := newTestArenaCache(t, "64KB", nil)
+
+	for i := 0; i < 100; i++ {
+		c.PutKey(Int(i), ByteSlc("value-"+strconv.Itoa(i)))
+	}
+
+	value, ok := c.Get(42)
+	if !ok || string(value) != "value-42" {
+		t.Fatalf("got %q, %v, want value-42", value, ok)
+	}
+
+	// The value is a copy, a later write to the arena does not change it.
+	c.PutKey(42, ByteSlc("other-42"))
+	if string(value) != "value-42" {
+		t.Errorf("value returned by get changed to %q", value)
+	}
+
+	if !c.Delete(42) {
+		t.Errorf("delete of a cached key reported no value")
+	}
+	if _, ok = c.Get(42); ok {
+		t.Errorf("deleted key is cached")
+	}
+
+	loaded, err := c.GetOrLoad(1000, func(Int) (ByteSlc, error) { return ByteSlc("loaded"), nil })
+	if err != nil || string(loaded) != "loaded" {
+		t.Fatalf("load returned %q, %v", loaded, err)
+	}
+	if value, ok = c.Get(1000); !ok || string(value) != "loaded" {
+		t.Errorf("loaded value is not cached")
+	}
+
+	var got []Int
+	c.Range(func(key Int, value ByteSlc) bool {
+		if key != 1000 && string(value) != "value-"+strconv.Itoa(int(key)) {
+			t.Errorf("range returned %q for %d", value, key)
+		}
+		got = append(got, key)
+		return true
+	})
+	if len(got) != 100 {
+		t.Errorf("range returned %d values, want 100", len(got))
+	}
+
+	c.Clear()
+	if c.Len() != 0 {
+		t.Errorf("cache holds %d values after clear", c.Len())
+	}
+	c.PutKey(1, ByteSlc("after-clear"))
+	if value, ok = c.Get(1); !ok || string(value) != "after-clear" {
+		t.Errorf("got %q, %v after clear", value, ok)
+	}
+}
+
+// TestArenaStorageReclaim overwrites a few hot keys many times, so the ring wraps over
+// entries of replaced values and entries of the other keys, which are moved and kept.
+func TestArenaStorageReclaim(t *testing.T) {
+	c := newTestArenaCache(t, "16KB", map[string]any{"cache.buckets-amount": 1})
+
+	for i := 0; i < 20; i++ {
+		c.PutKey(Int(1000+i), bytes.Repeat([]byte{byte(i)}, 100))
+	}
+	for round := 0; round < 1000; round++ {
+		c.PutKey(Int(round%5), ByteSlc(fmt.Sprintf("%d-%d", round%5, round)))
+	}
+
+	for i := 0; i < 20; i++ {
+		value, ok := c.Get(Int(1000 + i))
+		if !ok || !bytes.Equal(value, bytes.Repeat([]byte{byte(i)}, 100)) {
+			t.Errorf("got %x, %v for %d, want its value kept", value, ok, 1000+i)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		value, ok := c.Get(Int(i))
+		if want := fmt.Sprintf("%d-%d", i, 995+i); !ok || string(value) != want {
+			t.Errorf("got %q, %v for %d, want %q", value, ok, i, want)
+		}
+	}
+}
+
+func TestArenaStorageEviction(t *testing.T) {
+	c := newTestArenaCache(t, "64KB", nil)
+
+	var evicted int
+	c.OnEvict(func(key Int, value ByteSlc, reason RemoveReason) {
+		if reason != ReasonCapacity || len(value) != 200 || value[0] != byte(key%256) {
+			t.Errorf("evicted %d with %d bytes for %v", key, len(value), reason)
+		}
+		evicted++
+	})
+
+	value := make(ByteSlc, 200)
+	for i := 0; i < 10_000; i++ {
+		value[0] = byte(i % 256)
+		c.PutKey(Int(i), value)
+	}
+
+	got, ok := c.Get(9_999)
+	if !ok || len(got) != len(value) || got[0] != byte(9_999%256) {
+		t.Errorf("last put value is not cached")
+	}
+	if _, ok = c.Get(0); ok {
+		t.Errorf("oldest value was not evicted")
+	}
+	if c.Len() == 0 || c.Len() > 64<<10/200 {
+		t.Errorf("cache holds %d values", c.Len())
+	}
+	if evicted+c.Len() != 10_000 {
+		t.Errorf("%d values evicted and %d cached, want 10000 in total", evicted, c.Len())
+	}
+
+	c.Range(func(key Int, value ByteSlc) bool {
+		if len(value) != 200 || value[0] != byte(key%256) {
+			t.Errorf("cached value of %d is corrupted", key)
+		}
+		return true
+	})
+}
@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"time"
+)
+
+// GetMany looks up keys taking every bucket lock once. It returns the cached values and
+// the keys that are missing, expired or cached as negative results, in no particular order.
+func (c *Cache[K, V]) GetMany(keys []K) (map[K]V, []K) {
+	found := make(map[K]V, len(keys))
+	var missing []K
+
+	for i, group := range c.groupKeys(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		missing = c.buckets[i].getMany(group, found, missing)
+	}
+
+	return found, missing
+}
+
+// PutMany stores data read from the source at readAt with the default ttl from cache.ttl,
+// taking every bucket lock once. Like GetOrLoad it stores keys that hold no value and were
+// not deleted since readAt only, since a value put or a delete after readAt is newer than
+// data. Tombstones are skipped.
+func (c *Cache[K, V]) PutMany(data []Data[K, V], readAt time.Time) {
+	c.putMany(data, readAt.UnixNano())
+}
+
+// putMany skips keys deleted at or after start, a zero start skips every key deleted
+// less than cache.delete-tombstone-ttl ago.
+func (c *Cache[K, V]) putMany(data []Data[K, V], start int64) {
+	expireAt := expireAtFor(c.ttl)
+
+	groups := make([][]batchItem[K, V], c.bucketsAmount)
+	for _, d := range data {
+		if d.Deleted {
+			continue
+		}
+
+		i := c.bucketIndex(d.Key)
+		groups[i] = append(groups[i], batchItem[K, V]{key: d.Key, item: c.newItem(d.Value, expireAt)})
+	}
+
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		c.buckets[i].putMany(group, start)
+	}
+}
+
+type batchItem[K Key[K], V Codec[V]] struct {
+	key  K
+	item Item[K, V]
+}
+
+func (c *Cache[K, V]) groupKeys(keys []K) [][]K {
+	groups := make([][]K, c.bucketsAmount)
+	for _, key := range keys {
+		i := c.bucketIndex(key)
+		groups[i] = append(groups[i], key)
+	}
+	return groups
+}
+
+// getMany adds the values of keys to found and appends the other keys to missing.
+// getMany looks keys up in memory and then the missing ones in the file store.
+func (c *bucket[K, V]) getMany(keys []K, found map[K]V, missing []K) []K {
+	start := len(missing)
+	missing = c.getManyCached(keys, found, missing)
+	if c.store != nil {
+		missing = c.promoteMany(missing, start, found)
+	}
+
+	misses := len(missing) - start
+	c.metrics.hits.Add(float64(len(keys) - misses))
+	c.metrics.misses.Add(float64(misses))
+
+	return missing
+}
+
+func (c *bucket[K, V]) getManyCached(keys []K, found map[K]V, missing []K) []K {
+	if c.reads == nil {
+		c.lock()
+		defer c.unlock()
+	} else {
+		c.rlock()
+	}
+
+	now := time.Now().UnixNano()
+	var expired []K
+
+	for _, key := range keys {
+		item, ok := c.items[key]
+		if !ok || item.negative || item.expired(now) {
+			if ok && item.expired(now) {
+				expired = append(expired, key)
+			}
+			missing = append(missing, key)
+			continue
+		}
+
+		value, ok := c.valueOrMiss(item)
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+
+		found[key] = value
+
+		if c.reads == nil {
+			c.policy.Access(key)
+		}
+	}
+
+	if c.reads == nil {
+		for _, key := range expired {
+			if item, ok := c.items[key]; ok {
+				c.removeItem(key, item, ReasonExpired)
+				c.metrics.expiredOnGet.Inc()
+			}
+		}
+	} else {
+		c.mx.RUnlock()
+
+		for _, key := range expired {
+			c.removeExpired(key)
+		}
+		for _, key := range keys {
+			if _, ok := found[key]; ok {
+				c.recordRead(key)
+			}
+		}
+	}
+
+	return missing
+}
+
+// putMany stores items of keys that hold no value and were not deleted at or after start.
+func (c *bucket[K, V]) putMany(items []batchItem[K, V], start int64) {
+	c.lock()
+	defer c.unlock()
+
+	now := time.Now().UnixNano()
+	for _, item := range items {
+		old, ok := c.items[item.key]
+		if ok && !old.negative && !old.expired(now) {
+			continue
+		}
+		if c.deletedSince(item.key, start) {
+			continue
+		}
+		c.storeItem(item.key, item.item)
+	}
+}
@@ -0,0 +1,259 @@
+package cache
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var tracePath = flag.String("trace", "", "file with one product id per line replayed by BenchmarkEvictionPolicies")
+
+const (
+	benchKeysAmount  = 10000
+	benchPayloadSize = 512
+	// benchWriteEvery makes one of that many operations of the mixed benchmarks a put.
+	benchWriteEvery = 20
+
+	// gcKeysAmount small values are stored to compare the gc cost of the storage layouts.
+	gcKeysAmount  = 1000000
+	gcPayloadSize = 64
+	gcGoroutines  = 8
+
+	// The synthetic trace: a hot set most requests go to, that fits into the cache,
+	// and paged scans over cold ids, like /api/v1/product/all, that do not.
+	traceCapacity  = 1000
+	traceHotKeys   = 700
+	traceColdKeys  = 100000
+	traceRequests  = 200000
+	traceScanEvery = 2000
+	traceScanSize  = 1000
+)
+
+func newBenchCache(b *testing.B, readBufferSize int) *Cache[Int, ByteSlc] {
+	c := newTestCache[Int, ByteSlc](b, map[string]any{
+		"cache.buckets-amount":            8,
+		"cache.elems.threshold":           benchKeysAmount * 2,
+		"cache.elems.remains-after-clean": benchKeysAmount,
+		"cache.read-buffer-size":          readBufferSize,
+	})
+	for i := 0; i < benchKeysAmount; i++ {
+		c.PutKey(Int(i), make(ByteSlc, benchPayloadSize))
+	}
+	return c
+}
+
+// BenchmarkGet compares a typed get with a get that marshals the value, as every hit did
+// before values were stored typed.
+func BenchmarkGet(b *testing.B) {
+	c := newBenchCache(b, 64)
+
+	b.Run("typed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = c.Get(Int(i % benchKeysAmount))
+		}
+	})
+
+	b.Run("marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			value, _ := c.Get(Int(i % benchKeysAmount))
+			_, _ = value.Marshal()
+		}
+	})
+}
+
+// BenchmarkParallelGet compares gets under the exclusive lock, read buffer 0, with gets
+// under the read lock. The difference shows with several CPUs only.
+func BenchmarkParallelGet(b *testing.B) {
+	for _, readBufferSize := range []int{0, 64} {
+		c := newBenchCache(b, readBufferSize)
+
+		for _, goroutines := range []int{1, 8, 64} {
+			b.Run(fmt.Sprintf("get/read-buffer-%d/goroutines-%d", readBufferSize, goroutines), func(b *testing.B) {
+				parallel(b, goroutines, func(i int) {
+					_, _ = c.Get(Int(i % benchKeysAmount))
+				})
+			})
+
+			b.Run(fmt.Sprintf("get-put/read-buffer-%d/goroutines-%d", readBufferSize, goroutines), func(b *testing.B) {
+				parallel(b, goroutines, func(i int) {
+					if i%benchWriteEvery == 0 {
+						c.PutKey(Int(i%benchKeysAmount), make(ByteSlc, benchPayloadSize))
+						return
+					}
+					_, _ = c.Get(Int(i % benchKeysAmount))
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkStorageGC fills a cache of every storage with many small values and reports how
+// long a forced gc takes with it alive, and its get throughput. Every cache is filled once
+// for all runs of its benchmark. The arena storage goes first, the map storage is never
+// collected since its cleaners keep running.
+func BenchmarkStorageGC(b *testing.B) {
+	payload := make(ByteSlc, gcPayloadSize)
+
+	for _, storage := range []string{StorageArena, StorageMap} {
+		var items *Cache[Int, ByteSlc]
+		b.Run(storage, func(b *testing.B) {
+			if items == nil {
+				items = newTestCache[Int, ByteSlc](b, map[string]any{
+					"cache.storage":                   storage,
+					"cache.buckets-amount":            8,
+					"cache.max-bytes":                 "256MB",
+					"cache.elems.threshold":           gcKeysAmount * 2,
+					"cache.elems.remains-after-clean": gcKeysAmount,
+					"cache.read-buffer-size":          64,
+				})
+				for i := 0; i < gcKeysAmount; i++ {
+					items.PutKey(Int(i), append(ByteSlc(nil), payload...))
+				}
+			}
+
+			benchmarkGC(b, func(i int) {
+				_, _ = items.Get(Int(i % gcKeysAmount))
+			})
+		})
+
+		items = nil
+		runtime.GC()
+	}
+}
+
+// benchmarkGC reports the gc cycle time and the heap objects as metrics of a parallel get benchmark.
+func benchmarkGC(b *testing.B, get func(i int)) {
+	runtime.GC()
+
+	start := time.Now()
+	runtime.GC()
+	gcTime := time.Since(start)
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	b.ReportAllocs()
+	parallel(b, gcGoroutines, get)
+
+	b.ReportMetric(float64(gcTime.Microseconds()), "gc-µs")
+	b.ReportMetric(float64(stats.HeapObjects), "heap-objects")
+}
+
+// parallel splits b.N operations between goroutines, so ns/op is the inverse of the total throughput.
+func parallel(b *testing.B, goroutines int, op func(i int)) {
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+
+	perGoroutine := b.N/goroutines + 1
+	b.ResetTimer()
+	for g := 0; g < goroutines; g++ {
+		go func(offset int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				op(offset + i*7919)
+			}
+		}(g * perGoroutine)
+	}
+	wg.Wait()
+}
+
+// BenchmarkEvictionPolicies replays a key trace against every eviction policy and reports
+// the hit ratio of each. Pass -trace to replay product ids from a file instead of the
+// synthetic trace, where LRU loses the hot set to every scan while LFU and 2Q keep most of it.
+func BenchmarkEvictionPolicies(b *testing.B) {
+	trace := syntheticTrace()
+	if *tracePath != "" {
+		var err error
+		trace, err = readTrace(*tracePath)
+		if err != nil {
+			b.Fatalf("failed to read trace, error: %v", err)
+		}
+	}
+
+	for _, policy := range []string{PolicyLRU, PolicyLFU, Policy2Q} {
+		b.Run(policy, func(b *testing.B) {
+			var hits, requests int
+			for i := 0; i < b.N; i++ {
+				// Every value takes one byte, so the bytes budget evicts synchronously on put
+				// and the result does not depend on the scheduling of the threshold cleaner.
+				c := newTestCache[Int, ByteSlc](b, map[string]any{
+					"cache.buckets-amount":            1,
+					"cache.elems.threshold":           traceCapacity + 1,
+					"cache.elems.remains-after-clean": traceCapacity,
+					"cache.max-bytes":                 traceCapacity,
+					"cache.eviction-policy":           policy,
+					"cache.read-buffer-size":          0,
+				})
+
+				for _, key := range trace {
+					requests++
+					if _, ok := c.Get(key); ok {
+						hits++
+						continue
+					}
+					c.PutKey(key, ByteSlc{0})
+				}
+			}
+
+			b.ReportMetric(float64(hits)/float64(requests), "hit-ratio")
+		})
+	}
+}
+
+func syntheticTrace() []Int {
+	rnd := rand.New(rand.NewSource(1))
+	trace := make([]Int, 0, traceRequests+traceRequests/traceScanEvery*traceScanSize)
+
+	scanned := traceHotKeys
+	for i := 0; i < traceRequests; i++ {
+		if i%traceScanEvery == traceScanEvery-1 {
+			for j := 0; j < traceScanSize; j++ {
+				trace = append(trace, Int(scanned))
+				scanned = traceHotKeys + (scanned-traceHotKeys+1)%traceColdKeys
+			}
+		}
+
+		if rnd.Intn(10) < 9 {
+			trace = append(trace, Int(rnd.Intn(traceHotKeys)))
+		} else {
+			trace = append(trace, Int(traceHotKeys+rnd.Intn(traceColdKeys)))
+		}
+	}
+
+	return trace
+}
+
+func readTrace(path string) ([]Int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	var trace []Int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		id, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		trace = append(trace, Int(id))
+	}
+
+	return trace, scanner.Err()
+}
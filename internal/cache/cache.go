@@ -2,299 +2,822 @@ package cache
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
-	"github.com/PrettyPepeBoy/WorkWithNats/pkg/list"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
-	"hash"
-	"hash/fnv"
+	"hash/maphash"
 	"io"
 	"sync"
-	"unsafe"
+	"time"
 )
 
-var (
-	threshold int
-	remains   int
+const (
+	triggerGet   = "get"
+	triggerSweep = "sweep"
 )
 
-type Marshaller interface {
-	Marshal() ([]byte, error)
-}
-
-type Key interface {
-	Marshaller
-	comparable
-}
-
-type bucket[K Key, V Marshaller] struct {
-	mx                sync.Mutex
+type bucket[K Key[K], V Codec[V]] struct {
+	mx                sync.RWMutex
 	items             map[K]Item[K, V]
-	list              *list.List[K]
-	elements          []list.Element[K]
+	policy            EvictionPolicy[K]
+	newPolicy         func() EvictionPolicy[K]
+	negatives         int
+	hooks             *hooks[K, V]
+	removed           []removal[K, V]
 	cleanChan         chan struct{}
 	threshold         int
-	index             int
 	remainsAfterClear int
+	bytes             int
+	maxBytes          int
+	metrics           *bucketMetrics
+	compressor        *compressor
+	// store persists the values of the bucket, nil unless cache.file-store.path is set.
+	store *fileStore[K]
+	// arena holds the values of the bucket, nil unless cache.storage is arena.
+	arena *arena
+	// tombstones remember deleted keys for tombstoneTTL, see PutIfNewer.
+	tombstones   map[K]tombstone
+	tombstoneTTL time.Duration
+	pruneAt      int
+	// reads buffers keys hit under the read lock until the policy is updated under the write lock,
+	// nil if every get takes the write lock.
+	reads chan K
+	// dirty holds keys changed since the last snapshot, nil unless TrackChanges was called.
+	dirty map[K]struct{}
 }
 
-type Item[K Key, V Marshaller] struct {
-	element *list.Element[K]
-	Data    V
-	index   int
+type Item[K Key[K], V Codec[V]] struct {
+	Data V
+	size int
+	// negative marks a key the loader reported as not found.
+	negative bool
+	// expireAt is a unix time in nanoseconds, zero means the item never expires.
+	expireAt int64
+	// version orders writes of PutIfNewer and CompareAndSwap, zero for unversioned writes.
+	version uint64
+	// packed holds the marshalled value instead of Data, compressed unless raw is set,
+	// nil if Data is stored as is.
+	packed []byte
+	raw    bool
+	// offset is the position of packed in the bucket arena if inArena is set, packed is nil then.
+	offset  uint32
+	inArena bool
 }
 
-type Cache[K Key, V Marshaller] struct {
-	buckets       []bucket[K, V]
+func (i Item[K, V]) expired(now int64) bool {
+	return i.expireAt != 0 && i.expireAt <= now
+}
+
+type Cache[K Key[K], V Codec[V]] struct {
+	buckets       []*bucket[K, V]
 	bucketsAmount int
-	hash          hasher[K]
+	seed          maphash.Seed
+	ttl           time.Duration
+	negativeTTL   time.Duration
+	loads         group[K, V]
+	hooks         hooks[K, V]
+	compressor    *compressor
+	store         *fileStore[K]
+	// arenas is set if values are marshalled into bucket arenas, see cache.storage.
+	arenas bool
 }
 
-func NewCache[K Key, V Marshaller]() *Cache[K, V] {
-	threshold = viper.GetInt("cache.elems.threshold")
+// NewCache creates a cache configured from the cache section, name labels its metrics in reg.
+// With cache.compression.algorithm set, values longer than cache.compression.threshold
+// bytes when marshalled are stored compressed and decompressed on every read.
+// With cache.file-store.path set, values are also written to a memory mapped file, see Persistent.
+// With cache.storage set to arena, values are stored marshalled in a preallocated arena per
+// bucket of cache.max-bytes in total instead of on the heap, and are unmarshalled on every read.
+func NewCache[K Key[K], V Codec[V]](name string, reg prometheus.Registerer) *Cache[K, V] {
+	threshold := viper.GetInt("cache.elems.threshold")
+	remainsAfterClear := viper.GetInt("cache.elems.remains-after-clean")
+	sweepInterval := viper.GetDuration("cache.ttl-sweep-interval")
+	maxBytes := int(viper.GetSizeInBytes("cache.max-bytes"))
+	readBufferSize := viper.GetInt("cache.read-buffer-size")
+	m := newMetrics(name, reg)
+
+	policyName := viper.GetString("cache.eviction-policy")
+	newPolicy, err := newPolicyFactory[K](policyName, threshold)
+	if err != nil {
+		logrus.Errorf("failed to create eviction policy %q, falling back to %s, error: %v", policyName, PolicyLRU, err)
+		newPolicy, _ = newPolicyFactory[K](PolicyLRU, threshold)
+	}
 
 	var c Cache[K, V]
+	if viper.GetString("cache.compression.algorithm") != CompressionNone {
+		c.compressor, err = newCompressor(newCompressionMetrics(name, reg))
+		if err != nil {
+			logrus.Errorf("failed to create cache compressor, storing values uncompressed, error: %v", err)
+		}
+	}
+	if path := viper.GetString("cache.file-store.path"); path != "" {
+		c.store, err = openFileStore[K](
+			path,
+			int(viper.GetSizeInBytes("cache.file-store.initial-size")),
+			viper.GetFloat64("cache.file-store.compact-ratio"),
+			viper.GetDuration("cache.file-store.sync-interval"),
+		)
+		if err != nil {
+			logrus.Errorf("failed to open cache file store, keeping values in memory only, error: %v", err)
+		}
+	}
+	storage := viper.GetString("cache.storage")
+	arenaSize, err := newStorage(storage, maxBytes, viper.GetInt("cache.buckets-amount"))
+	if err != nil {
+		logrus.Errorf("failed to use cache storage %q, falling back to %s, error: %v", storage, StorageMap, err)
+	}
+	c.arenas = arenaSize > 0
+	if c.arenas {
+		maxBytes = arenaSize * viper.GetInt("cache.buckets-amount")
+	}
+
+	c.ttl = viper.GetDuration("cache.ttl")
+	c.negativeTTL = viper.GetDuration("cache.negative-ttl")
+	c.loads.calls = make(map[K]*call[V])
 	c.bucketsAmount = viper.GetInt("cache.buckets-amount")
-	c.buckets = make([]bucket[K, V], c.bucketsAmount)
+	c.buckets = make([]*bucket[K, V], c.bucketsAmount)
 	for i := range c.buckets {
-		c.buckets[i] = *newCacheBucket[K, V]()
+		c.buckets[i] = newCacheBucket[K, V](threshold, remainsAfterClear, maxBytes/c.bucketsAmount, readBufferSize, newPolicy, &c.hooks, m.forBucket(i))
+		c.buckets[i].compressor = c.compressor
+		c.buckets[i].store = c.store
+		if c.arenas {
+			c.buckets[i].arena = newArena(arenaSize)
+		}
+		c.buckets[i].tombstoneTTL = viper.GetDuration("cache.delete-tombstone-ttl")
+		c.buckets[i].startSweeper(sweepInterval)
 	}
 
-	c.hash = *newHasher[K]()
+	c.seed = maphash.MakeSeed()
 
 	return &c
 }
 
-func newCacheBucket[K Key, V Marshaller]() *bucket[K, V] {
-	m := make(map[K]Item[K, V])
+// newStorage returns the arena size of a bucket for the named storage, zero for the map storage.
+func newStorage(name string, maxBytes, bucketsAmount int) (int, error) {
+	switch name {
+	case StorageMap, "":
+		return 0, nil
+	case StorageArena:
+		return arenaSizeFor(maxBytes, bucketsAmount)
+	default:
+		return 0, ErrUnknownStorage
+	}
+}
 
+// newCacheBucket creates a bucket, a non-positive maxBytes disables the bytes budget.
+// With a positive readBufferSize gets run under the read lock and report accesses to the
+// policy through a buffer of that size, accesses that do not fit into it are dropped.
+func newCacheBucket[K Key[K], V Codec[V]](threshold, remainsAfterClear, maxBytes, readBufferSize int, newPolicy func() EvictionPolicy[K], h *hooks[K, V], m *bucketMetrics) *bucket[K, V] {
 	c := &bucket[K, V]{
-		items:     m,
-		list:      list.NewList[K](),
-		cleanChan: make(chan struct{}),
-		elements:  make([]list.Element[K], threshold),
-		threshold: threshold,
+		items:             make(map[K]Item[K, V]),
+		policy:            newPolicy(),
+		newPolicy:         newPolicy,
+		hooks:             h,
+		cleanChan:         make(chan struct{}, 1),
+		threshold:         threshold,
+		remainsAfterClear: remainsAfterClear,
+		maxBytes:          maxBytes,
+		metrics:           m,
+	}
+	if readBufferSize > 0 {
+		c.reads = make(chan K, readBufferSize)
 	}
 	c.startClearCache()
 	return c
 }
 
-func (c *bucket[K, V]) putKey(key K, value V) {
+// lock acquires c.mx, records how long it took and applies buffered reads to the policy.
+func (c *bucket[K, V]) lock() {
+	start := time.Now()
 	c.mx.Lock()
-	defer c.mx.Unlock()
+	c.metrics.lockWait.Observe(time.Since(start).Seconds())
+	c.drainReads()
+}
+
+// rlock acquires c.mx for reading and records how long it took.
+func (c *bucket[K, V]) rlock() {
+	start := time.Now()
+	c.mx.RLock()
+	c.metrics.lockWait.Observe(time.Since(start).Seconds())
+}
+
+// recordRead buffers an access to key made under the read lock. When the buffer is full
+// it is drained if the write lock is free, otherwise the access is dropped.
+func (c *bucket[K, V]) recordRead(key K) {
+	select {
+	case c.reads <- key:
+		return
+	default:
+	}
+
+	if c.mx.TryLock() {
+		c.drainReads()
+		c.policy.Access(key)
+		c.unlock()
+	}
+}
+
+// drainReads must be called with c.mx held.
+func (c *bucket[K, V]) drainReads() {
+	for {
+		select {
+		case key := <-c.reads:
+			c.policy.Access(key)
+		default:
+			return
+		}
+	}
+}
+
+// unlock releases c.mx, updates the entries gauge and runs the hooks for values removed while it was held.
+func (c *bucket[K, V]) unlock() {
+	removed := c.removed
+	c.removed = nil
+	c.metrics.bucketEntries.Set(float64(len(c.items) - c.negatives))
+	c.mx.Unlock()
+
+	c.hooks.run(removed, c.valueOrMiss)
+}
+
+// newItem compresses value if it is long enough, it is called before taking a bucket lock.
+func (c *Cache[K, V]) newItem(value V, expireAt int64) Item[K, V] {
+	return newItem[K](c.compressor, c.arenas, value, expireAt)
+}
+
+// newItem marshals value if it is compressed or marshal is set, so it can be moved into an arena.
+func newItem[K Key[K], V Codec[V]](comp *compressor, marshal bool, value V, expireAt int64) Item[K, V] {
+	if comp != nil || marshal {
+		raw, err := value.Marshal()
+		if err == nil {
+			if comp != nil {
+				if packed, ok := comp.pack(raw); ok {
+					return Item[K, V]{
+						size:     len(packed),
+						expireAt: expireAt,
+						packed:   packed,
+					}
+				}
+			}
+			if marshal {
+				return Item[K, V]{
+					size:     len(raw),
+					expireAt: expireAt,
+					packed:   raw,
+					raw:      true,
+				}
+			}
+		}
+	}
+
+	return Item[K, V]{
+		Data:     value,
+		size:     sizeOf(value),
+		expireAt: expireAt,
+	}
+}
+
+// value returns the value of item, decompressing it if needed. It must be called with
+// c.mx held for items in the arena, see detach.
+func (c *bucket[K, V]) value(item Item[K, V]) (V, error) {
+	if item.packed == nil && !item.inArena {
+		return item.Data, nil
+	}
+
+	var zero V
+	raw, err := c.marshalled(item)
+	if err != nil {
+		return zero, err
+	}
+	return zero.Unmarshal(raw)
+}
 
-	c.elements[c.index] = list.Element[K]{
-		Value: key,
+// marshalled returns the marshalled value of item, it must be called with c.mx held for
+// items in the arena and the result then shares memory with the arena.
+func (c *bucket[K, V]) marshalled(item Item[K, V]) ([]byte, error) {
+	packed := item.packed
+	if item.inArena {
+		_, packed = c.arena.entry(int(item.offset))
 	}
 
-	c.items[key] = Item[K, V]{
-		element: c.list.Put(&c.elements[c.index]),
-		Data:    value,
-		index:   c.index,
+	switch {
+	case packed == nil:
+		return item.Data.Marshal()
+	case item.raw:
+		return packed, nil
+	default:
+		return c.compressor.unpack(packed)
 	}
-	c.index++
+}
 
-	if c.index == c.threshold {
-		c.cleanChan <- struct{}{}
+// valueOrMiss is value for read paths, which report a value that fails to decompress as a miss.
+func (c *bucket[K, V]) valueOrMiss(item Item[K, V]) (V, bool) {
+	value, err := c.value(item)
+	if err != nil {
+		logrus.Errorf("failed to decompress cached value, error: %v", err)
+		return value, false
 	}
+	return value, true
 }
 
+func (c *bucket[K, V]) putItem(key K, item Item[K, V]) {
+	c.lock()
+	defer c.unlock()
+
+	c.storeItem(key, item)
+}
+
+// storeItem inserts item and persists it, it must be called with c.mx held.
+func (c *bucket[K, V]) storeItem(key K, item Item[K, V]) {
+	if !item.negative {
+		c.metrics.puts.Inc()
+		if c.arena != nil {
+			item = c.arenaStore(key, item)
+		}
+		if c.maxBytes <= 0 || item.size <= c.maxBytes {
+			c.persist(key, item)
+		}
+	}
+
+	c.insert(key, item)
+}
+
+// insert must be called with c.mx held.
+func (c *bucket[K, V]) insert(key K, item Item[K, V]) {
+
+	old, ok := c.items[key]
+	if c.maxBytes > 0 && item.size > c.maxBytes {
+		if ok {
+			c.removeItem(key, old, ReasonReplaced)
+		}
+		return
+	}
+
+	if ok {
+		c.record(key, old, ReasonReplaced)
+		c.metrics.removedBy[ReasonReplaced].Inc()
+		c.addBytes(item.size - old.size)
+		c.addNegatives(old, -1)
+		c.policy.Access(key)
+	} else {
+		c.addBytes(item.size)
+		c.policy.Add(key)
+	}
+
+	c.items[key] = item
+	c.addNegatives(item, 1)
+	c.markDirty(key, item)
+
+	c.evictOverBudget()
+
+	if len(c.items) >= c.threshold {
+		select {
+		case c.cleanChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// PutKey stores value with the default ttl from cache.ttl.
 func (c *Cache[K, V]) PutKey(key K, value V) {
-	i := int(c.hash.getHash(key)) % c.bucketsAmount
-	c.buckets[i].putKey(key, value)
+	c.PutKeyWithTTL(key, value, c.ttl)
+}
+
+// PutKeyWithTTL stores value for ttl, a non-positive ttl stores it without expiration.
+func (c *Cache[K, V]) PutKeyWithTTL(key K, value V, ttl time.Duration) {
+	c.bucketFor(key).putItem(key, c.newItem(value, expireAtFor(ttl)))
+}
+
+func expireAtFor(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
 }
 
+func (c *Cache[K, V]) bucketFor(key K) *bucket[K, V] {
+	return c.buckets[c.bucketIndex(key)]
+}
+
+func (c *Cache[K, V]) bucketIndex(key K) uint64 {
+	return key.Hash(c.seed) % uint64(c.bucketsAmount)
+}
+
+// removeKey reports whether a value, not a negative result, was removed.
 func (c *bucket[K, V]) removeKey(key K) bool {
-	c.mx.Lock()
-	defer c.mx.Unlock()
+	c.lock()
+	defer c.unlock()
 	item, ok := c.items[key]
+	c.addTombstone(key, item.version)
 	if !ok {
 		return false
 	}
 
+	c.removeItem(key, item, ReasonDeleted)
+	return !item.negative
+}
+
+// Delete removes key from the cache and reports whether it held a value.
+func (c *Cache[K, V]) Delete(key K) bool {
+	return c.bucketFor(key).removeKey(key)
+}
+
+// removeItem must be called with c.mx held.
+func (c *bucket[K, V]) removeItem(key K, item Item[K, V], reason RemoveReason) {
+	if !item.negative {
+		c.unpersist(key)
+	}
+	c.record(key, item, reason)
+	c.metrics.removedBy[reason].Inc()
+	c.markDirty(key, item)
 	delete(c.items, key)
-	c.list.Remove(item.element)
-	return true
+	if reason == ReasonCapacity {
+		c.policy.Evict(key)
+	} else {
+		c.policy.Remove(key)
+	}
+	c.addBytes(-item.size)
+	c.addNegatives(item, -1)
 }
 
-func (c *bucket[K, V]) get(key K) (Marshaller, bool) {
-	c.mx.Lock()
-	defer c.mx.Unlock()
+// markDirty must be called with c.mx held.
+func (c *bucket[K, V]) markDirty(key K, item Item[K, V]) {
+	if c.dirty != nil && !item.negative {
+		c.dirty[key] = struct{}{}
+	}
+}
 
-	item, ok := c.items[key]
-	if !ok {
-		return nil, false
+func (c *bucket[K, V]) addBytes(delta int) {
+	c.bytes += delta
+	c.metrics.bucketBytes.Add(float64(delta))
+}
+
+func (c *bucket[K, V]) addNegatives(item Item[K, V], delta int) {
+	if item.negative {
+		c.negatives += delta
 	}
+}
 
-	c.list.Remove(item.element)
+func (c *bucket[K, V]) len() int {
+	c.rlock()
+	defer c.mx.RUnlock()
+	return len(c.items) - c.negatives
+}
 
-	c.elements[item.index] = list.Element[K]{
-		Value: key,
+// Len returns the number of cached values, expired values not yet removed are counted as well.
+func (c *Cache[K, V]) Len() int {
+	var n int
+	for _, b := range c.buckets {
+		n += b.len()
 	}
+	return n
+}
+
+func (c *bucket[K, V]) clear() {
+	c.lock()
+	defer c.unlock()
 
-	c.items[key] = Item[K, V]{
-		element: c.list.Put(&c.elements[item.index]),
-		Data:    item.Data,
-		index:   item.index,
+	for key, item := range c.items {
+		if !item.negative {
+			c.unpersist(key)
+		}
+		c.record(key, item, ReasonDeleted)
+		c.markDirty(key, item)
 	}
+	c.metrics.removedBy[ReasonDeleted].Add(float64(len(c.items) - c.negatives))
 
-	return item.Data, true
+	c.items = make(map[K]Item[K, V])
+	c.policy = c.newPolicy()
+	if c.arena != nil {
+		c.arena.reset()
+	}
+	c.addBytes(-c.bytes)
+	c.negatives = 0
 }
 
-func (c *Cache[K, V]) Get(key K) (Marshaller, bool) {
-	i := int(c.hash.getHash(key)) % c.bucketsAmount
-	return c.buckets[i].get(key)
+// Clear removes every key from the cache.
+func (c *Cache[K, V]) Clear() {
+	for _, b := range c.buckets {
+		b.clear()
+	}
 }
 
-type Data[K Key, V Marshaller] struct {
-	Key   K
-	Value V
-}
+// entries returns a copy of the unexpired values, so the caller can use it without holding c.mx.
+func (c *bucket[K, V]) entries() []Data[K, V] {
+	c.rlock()
+	defer c.mx.RUnlock()
 
-func (c *bucket[K, V]) dump() func(w *bufio.Writer) {
-	return func(w *bufio.Writer) {
-		c.mx.Lock()
-		defer c.mx.Unlock()
+	now := time.Now().UnixNano()
+	data := make([]Data[K, V], 0, len(c.items)-c.negatives)
+	for key, item := range c.items {
+		if item.negative || item.expired(now) {
+			continue
+		}
+		value, ok := c.valueOrMiss(item)
+		if !ok {
+			continue
+		}
+		data = append(data, Data[K, V]{Key: key, Value: value})
+	}
 
-		var buf bytes.Buffer
-		enc := newEncoder[K, V](&buf)
+	return data
+}
 
-		for key := range c.items {
-			data := Data[K, V]{
-				Key:   key,
-				Value: c.items[key].Data,
+// Range calls fn for every cached value until fn returns false. Buckets are copied one at a time,
+// so fn may call other cache methods, and writes made during Range may or may not be seen by it.
+func (c *Cache[K, V]) Range(fn func(K, V) bool) {
+	for _, b := range c.buckets {
+		for _, data := range b.entries() {
+			if !fn(data.Key, data.Value) {
+				return
 			}
+		}
+	}
+}
 
-			err := enc.encode(data)
-			if err != nil {
-				logrus.Errorf("failed to encode data, error: %v", err)
-				panic(err)
-			}
+// evictOverBudget removes items chosen by the eviction policy until the bucket fits into maxBytes.
+// It must be called with c.mx held.
+func (c *bucket[K, V]) evictOverBudget() {
+	if c.maxBytes <= 0 {
+		return
+	}
 
-			_, err = w.Write(buf.Bytes())
-			if err != nil {
-				logrus.Errorf("failed to write data to buffer, error: %v", err)
-				panic(err)
-			}
+	for c.bytes > c.maxBytes {
+		if !c.evictOne() {
+			return
 		}
 	}
 }
 
-func (c *Cache[K, V]) GetAllRawData(bufWriter *bufio.Writer) {
-	for i := 0; i < c.bucketsAmount; i++ {
-		c.buckets[i].dump()(bufWriter)
+// evictOne must be called with c.mx held.
+func (c *bucket[K, V]) evictOne() bool {
+	key, ok := c.policy.Victim()
+	if !ok {
+		return false
 	}
+
+	c.removeItem(key, c.items[key], ReasonCapacity)
+	return true
 }
 
-func (c *bucket[K, V]) startClearCache() {
-	go c.clearCache()
+// get looks key up in memory and then in the file store.
+func (c *bucket[K, V]) get(key K) (Item[K, V], bool) {
+	item, ok := c.getCached(key)
+	if !ok && c.store != nil {
+		return c.promote(key)
+	}
+	return item, ok
 }
 
-func (c *bucket[K, V]) clearCache() {
-	remains = viper.GetInt("cache.elems.remains_after_clean")
-	for range c.cleanChan {
-		c.mx.Lock()
-		e := c.list.Front()
-		for count := 0; count < remains; count++ {
-			delete(c.items, e.Value)
-			e = e.Next()
-		}
+func (c *bucket[K, V]) getCached(key K) (Item[K, V], bool) {
+	if c.reads == nil {
+		return c.getExclusive(key)
+	}
+
+	c.rlock()
+	item, ok := c.items[key]
+	item = c.detach(item)
+	c.mx.RUnlock()
+
+	if !ok {
+		return item, false
+	}
+
+	if item.expired(time.Now().UnixNano()) {
+		c.removeExpired(key)
+		return Item[K, V]{}, false
+	}
+
+	c.recordRead(key)
+
+	return item, true
+}
+
+// removeExpired removes key found expired under the read lock unless it was replaced since.
+func (c *bucket[K, V]) removeExpired(key K) {
+	c.lock()
+	defer c.unlock()
+
+	item, ok := c.items[key]
+	if ok && item.expired(time.Now().UnixNano()) {
+		c.removeItem(key, item, ReasonExpired)
+		c.metrics.expiredOnGet.Inc()
+	}
+}
+
+// getExclusive updates the policy right away under the write lock.
+func (c *bucket[K, V]) getExclusive(key K) (Item[K, V], bool) {
+	c.lock()
+	defer c.unlock()
+
+	item, ok := c.items[key]
+	if !ok {
+		return item, false
+	}
+
+	if item.expired(time.Now().UnixNano()) {
+		c.removeItem(key, item, ReasonExpired)
+		c.metrics.expiredOnGet.Inc()
+		return Item[K, V]{}, false
+	}
+
+	c.policy.Access(key)
 
-		if c.index == c.threshold {
-			c.index = c.remainsAfterClear
+	return c.detach(item), true
+}
+
+// Get returns the cached value without copying it. For reference types like ByteSlc
+// the result shares memory with the cache and must not be modified.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	b := c.bucketFor(key)
+
+	item, ok := b.get(key)
+	if ok && !item.negative {
+		var value V
+		value, ok = b.valueOrMiss(item)
+		if ok {
+			b.metrics.hits.Inc()
+			return value, true
 		}
+	}
 
-		c.list.RemoveFront(e.Prev())
-		c.mx.Unlock()
+	b.metrics.misses.Inc()
+	var zero V
+	return zero, false
+}
+
+// snapshotEntry is an item copied out of a bucket to be encoded without holding its lock.
+type snapshotEntry[K Key[K], V Codec[V]] struct {
+	key     K
+	item    Item[K, V]
+	deleted bool
+}
+
+func (c *bucket[K, V]) dump(enc *Encoder[K, V]) error {
+	c.lock()
+	entries := make([]snapshotEntry[K, V], 0, len(c.items)-c.negatives)
+	for key, item := range c.items {
+		if item.negative {
+			continue
+		}
+		entries = append(entries, snapshotEntry[K, V]{key: key, item: c.detach(item)})
+	}
+	if c.dirty != nil {
+		c.dirty = make(map[K]struct{})
 	}
+	c.unlock()
+
+	return c.encode(enc, entries)
 }
 
-type hasher[K comparable] struct {
-	size uintptr
-	hash hash.Hash32
+// dumpDirty writes the keys changed since the last dump, deleted keys are written as tombstones.
+func (c *bucket[K, V]) dumpDirty(enc *Encoder[K, V]) error {
+	c.lock()
+	entries := make([]snapshotEntry[K, V], 0, len(c.dirty))
+	for key := range c.dirty {
+		item, ok := c.items[key]
+		entries = append(entries, snapshotEntry[K, V]{key: key, item: c.detach(item), deleted: !ok || item.negative})
+	}
+	c.dirty = make(map[K]struct{})
+	c.unlock()
+
+	return c.encode(enc, entries)
 }
 
-func newHasher[K comparable]() *hasher[K] {
-	var tmp K
-	return &hasher[K]{
-		size: unsafe.Sizeof(tmp),
-		hash: fnv.New32(),
+// encode writes entries copied by dump or dumpDirty. It is called without c.mx held, so
+// a slow writer does not block the bucket.
+func (c *bucket[K, V]) encode(enc *Encoder[K, V], entries []snapshotEntry[K, V]) error {
+	for _, entry := range entries {
+		data := Data[K, V]{
+			Key:     entry.key,
+			Deleted: entry.deleted,
+		}
+
+		if !entry.deleted {
+			value, err := c.value(entry.item)
+			if err != nil {
+				return err
+			}
+			data.Value = value
+		}
+
+		err := enc.Encode(data)
+		if err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-func (h *hasher[K]) getHash(key K) uint32 {
-	ptr := (*byte)(unsafe.Pointer(&key))
-	data := unsafe.Slice(ptr, h.size)
+func (c *bucket[K, V]) trackChanges() {
+	c.lock()
+	defer c.unlock()
 
-	_, err := h.hash.Write(data)
-	if err != nil {
-		panic(err)
+	if c.dirty == nil {
+		c.dirty = make(map[K]struct{})
 	}
+}
 
-	return h.hash.Sum32()
+// TrackChanges makes the cache remember keys changed since the last snapshot, so WriteDelta can be used.
+func (c *Cache[K, V]) TrackChanges() {
+	for _, b := range c.buckets {
+		b.trackChanges()
+	}
 }
 
-type encoder[K Key, V Marshaller] struct {
-	writer io.Writer
+// WriteSnapshot writes every cached entry to w in the snapshot format and returns the number of records written.
+func (c *Cache[K, V]) WriteSnapshot(w io.Writer) (int, error) {
+	return c.write(w, (*bucket[K, V]).dump)
 }
 
-func newEncoder[K Key, V Marshaller](writer io.Writer) *encoder[K, V] {
-	return &encoder[K, V]{writer: writer}
+// WriteDelta writes entries changed since the previous WriteSnapshot or WriteDelta,
+// with tombstones for removed keys. It requires TrackChanges. If writing fails the
+// changes are lost from tracking, so the next snapshot must be a full one.
+func (c *Cache[K, V]) WriteDelta(w io.Writer) (int, error) {
+	return c.write(w, (*bucket[K, V]).dumpDirty)
 }
 
-func (enc *encoder[K, V]) encode(item Data[K, V]) error {
-	rawByteValue, err := item.Value.Marshal()
+func (c *Cache[K, V]) write(w io.Writer, dump func(*bucket[K, V], *Encoder[K, V]) error) (int, error) {
+	enc, err := NewEncoder[K, V](w)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = enc.writer.Write(rawByteValue)
-	if err != nil {
-		return err
+	for i := 0; i < c.bucketsAmount; i++ {
+		err = dump(c.buckets[i], enc)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	rawByteKey, err := item.Key.Marshal()
+	err = enc.Close()
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
-	_, err = enc.writer.Write(rawByteKey)
+	return enc.Count(), nil
+}
+
+func (c *Cache[K, V]) GetAllRawData(bufWriter *bufio.Writer) {
+	_, err := c.WriteSnapshot(bufWriter)
 	if err != nil {
-		return err
+		logrus.Errorf("failed to write cache snapshot, error: %v", err)
 	}
-
-	return nil
 }
 
-type Int int
+// Apply puts restored records into the cache like PutMany, keys deleted less than
+// cache.delete-tombstone-ttl ago are skipped, since the records are older than any delete.
+func (c *Cache[K, V]) Apply(data []Data[K, V]) {
+	c.putMany(data, 0)
+}
 
-func (i Int) Marshal() ([]byte, error) {
-	b := make([]byte, 0, 8)
-	binary.BigEndian.AppendUint64(b, uint64(i))
-	return b, nil
+func (c *bucket[K, V]) startClearCache() {
+	go c.clearCache()
 }
 
-type ByteSlc []byte
+func (c *bucket[K, V]) clearCache() {
+	for range c.cleanChan {
+		start := time.Now()
 
-func (slc ByteSlc) Marshal() ([]byte, error) {
-	b := make(ByteSlc, 0, 256)
-	b = append(b, slc...)
-	return b, nil
-}
+		c.lock()
+		for len(c.items) > c.remainsAfterClear {
+			if !c.evictOne() {
+				break
+			}
+		}
+		c.unlock()
 
-type Uint32 uint32
+		c.metrics.observeClean(cleanerThreshold, start)
+	}
+}
 
-func (ui Uint32) Marshal() ([]byte, error) {
-	b := make([]byte, 0, 4)
-	binary.BigEndian.AppendUint32(b, uint32(ui))
-	return b, nil
+func (c *bucket[K, V]) startSweeper(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go c.sweep(interval)
 }
 
-type Uint64 uint64
+// sweep periodically removes expired items that were not touched by get.
+func (c *bucket[K, V]) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		start := time.Now()
+		now := start.UnixNano()
+		expired := 0
+
+		c.lock()
+		for key, item := range c.items {
+			if item.expired(now) {
+				c.removeItem(key, item, ReasonExpired)
+				expired++
+			}
+		}
+		c.unlock()
 
-func (ui Uint64) Marshal() ([]byte, error) {
-	b := make([]byte, 0, 8)
-	binary.BigEndian.AppendUint64(b, uint64(ui))
-	return b, nil
+		c.metrics.expiredOnSweep.Add(float64(expired))
+		c.metrics.observeClean(cleanerSweep, start)
+	}
 }
@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+	"hash/maphash"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCache creates a cache from the default test configuration with overrides applied.
+func newTestCache[K Key[K], V Codec[V]](t testing.TB, overrides map[string]any) *Cache[K, V] {
+	t.Helper()
+
+	viper.Reset()
+	viper.Set("cache.elems.threshold", 1_000_000)
+	viper.Set("cache.elems.remains-after-clean", 1_000)
+	viper.Set("cache.buckets-amount", 16)
+	viper.Set("cache.read-buffer-size", 64)
+	viper.Set("cache.eviction-policy", PolicyLRU)
+	for key, value := range overrides {
+		viper.Set(key, value)
+	}
+
+	return NewCache[K, V](t.Name(), prometheus.NewRegistry())
+}
+
+func TestBucketSelection(t *testing.T) {
+	c := newTestCache[String, ByteSlc](t, nil)
+
+	for i := 0; i < 1000; i++ {
+		// Equal strings built separately do not share memory.
+		a := String("product-" + strconv.Itoa(i))
+		b := String(strings.Join([]string{"product", strconv.Itoa(i)}, "-"))
+
+		if c.bucketIndex(a) != c.bucketIndex(b) {
+			t.Fatalf("equal keys %q selected buckets %d and %d", a, c.bucketIndex(a), c.bucketIndex(b))
+		}
+		if first, second := c.bucketIndex(a), c.bucketIndex(a); first != second {
+			t.Fatalf("key %q selected bucket %d, then %d", a, first, second)
+		}
+	}
+
+	seed := maphash.MakeSeed()
+	for _, k := range []Hasher{Int(42), Uint32(42), Uint64(42), String("42")} {
+		if k.Hash(seed) != k.Hash(seed) {
+			t.Errorf("%T(%v) hashed to different values with the same seed", k, k)
+		}
+	}
+
+	used := make(map[uint64]struct{})
+	for i := 0; i < 1000; i++ {
+		used[c.bucketIndex(String(strconv.Itoa(i)))] = struct{}{}
+	}
+	if len(used) != c.bucketsAmount {
+		t.Errorf("1000 keys used %d of %d buckets", len(used), c.bucketsAmount)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	for _, readBufferSize := range []int{0, 64} {
+		overrides := map[string]any{"cache.read-buffer-size": readBufferSize}
+
+		t.Run(fmt.Sprintf("Int/read-buffer-%d", readBufferSize), func(t *testing.T) {
+			c := newTestCache[Int, ByteSlc](t, overrides)
+			hammer(t, c, func(i int) Int { return Int(i) })
+		})
+
+		t.Run(fmt.Sprintf("String/read-buffer-%d", readBufferSize), func(t *testing.T) {
+			c := newTestCache[String, ByteSlc](t, overrides)
+			hammer(t, c, func(i int) String { return String("key-" + strconv.Itoa(i)) })
+		})
+	}
+}
+
+// hammer runs puts, gets and deletes from many goroutines, each owning its keys and reading
+// a few keys of the others, and checks every goroutine sees its own writes.
+func hammer[K Key[K]](t *testing.T, c *Cache[K, ByteSlc], key func(int) K) {
+	const (
+		goroutines = 16
+		keys       = 200
+		rounds     = 5
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for round := 0; round < rounds; round++ {
+				for i := 0; i < keys; i++ {
+					k := key(g*keys + i)
+					value := ByteSlc(fmt.Sprintf("%d-%d-%d", g, i, round))
+					c.PutKey(k, value)
+
+					got, ok := c.Get(k)
+					if !ok || string(got) != string(value) {
+						errs <- fmt.Errorf("get of %v returned %q, %v after put of %q", k, got, ok, value)
+						return
+					}
+
+					c.Get(key(((g+1)%goroutines)*keys + i))
+
+					if i%3 == 0 {
+						c.Delete(k)
+						if _, ok = c.Get(k); ok {
+							errs <- fmt.Errorf("get of %v hit after delete", k)
+							return
+						}
+					}
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	want := goroutines * (keys - (keys+2)/3)
+	if c.Len() != want {
+		t.Errorf("cache holds %d values, want %d", c.Len(), want)
+	}
+}
+
+// blockingWriter blocks every write after the snapshot header until release is closed.
+type blockingWriter struct {
+	writes  int
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes == 2 {
+		close(w.writing)
+		<-w.release
+	}
+	return len(p), nil
+}
+
+func TestSnapshotWriterDoesNotBlockBucket(t *testing.T) {
+	c := newTestCache[Int, ByteSlc](t, map[string]any{"cache.buckets-amount": 1})
+	c.TrackChanges()
+	for i := 0; i < 10; i++ {
+		c.PutKey(Int(i), ByteSlc(strconv.Itoa(i)))
+	}
+
+	for name, write := range map[string]func(w io.Writer) (int, error){
+		"full":  c.WriteSnapshot,
+		"delta": c.WriteDelta,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := &blockingWriter{writing: make(chan struct{}), release: make(chan struct{})}
+			written := make(chan error)
+			go func() {
+				_, err := write(w)
+				written <- err
+			}()
+
+			<-w.writing
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				c.PutKey(100, ByteSlc("put while writing"))
+				c.Get(1)
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Errorf("put and get waited for the snapshot writer")
+			}
+
+			close(w.release)
+			if err := <-written; err != nil {
+				t.Errorf("failed to write snapshot, error: %v", err)
+			}
+			<-done
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/maphash"
+)
+
+type Marshaller interface {
+	Marshal() ([]byte, error)
+}
+
+// Unmarshaller is the counterpart of Marshaller. Unmarshal is called on the zero value
+// and returns the value decoded from b, so it must not depend on the receiver.
+type Unmarshaller[T any] interface {
+	Unmarshal(b []byte) (T, error)
+}
+
+type Codec[T any] interface {
+	Marshaller
+	Unmarshaller[T]
+}
+
+// Sizer is implemented by values that know their size without marshalling.
+type Sizer interface {
+	Size() int
+}
+
+func sizeOf[T Marshaller](v T) int {
+	if s, ok := any(v).(Sizer); ok {
+		return s.Size()
+	}
+
+	b, err := v.Marshal()
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// Hasher selects the bucket of a key. Equal keys must return equal hashes for the same seed.
+type Hasher interface {
+	Hash(seed maphash.Seed) uint64
+}
+
+type Key[T any] interface {
+	Codec[T]
+	Hasher
+	comparable
+}
+
+var (
+	ErrInvalidLength = errors.New("invalid length of raw data")
+)
+
+type Int int
+
+func (i Int) Marshal() ([]byte, error) {
+	b := make([]byte, 0, 8)
+	b = binary.BigEndian.AppendUint64(b, uint64(i))
+	return b, nil
+}
+
+func (Int) Size() int {
+	return 8
+}
+
+func (i Int) Hash(seed maphash.Seed) uint64 {
+	return hashUint64(seed, uint64(i))
+}
+
+func (Int) Unmarshal(b []byte) (Int, error) {
+	if len(b) != 8 {
+		return 0, ErrInvalidLength
+	}
+	return Int(binary.BigEndian.Uint64(b)), nil
+}
+
+type ByteSlc []byte
+
+func (slc ByteSlc) Marshal() ([]byte, error) {
+	b := make([]byte, len(slc))
+	copy(b, slc)
+	return b, nil
+}
+
+func (slc ByteSlc) Size() int {
+	return len(slc)
+}
+
+func (ByteSlc) Unmarshal(b []byte) (ByteSlc, error) {
+	slc := make(ByteSlc, len(b))
+	copy(slc, b)
+	return slc, nil
+}
+
+type Uint32 uint32
+
+func (ui Uint32) Marshal() ([]byte, error) {
+	b := make([]byte, 0, 4)
+	b = binary.BigEndian.AppendUint32(b, uint32(ui))
+	return b, nil
+}
+
+func (Uint32) Size() int {
+	return 4
+}
+
+func (ui Uint32) Hash(seed maphash.Seed) uint64 {
+	return hashUint64(seed, uint64(ui))
+}
+
+func (Uint32) Unmarshal(b []byte) (Uint32, error) {
+	if len(b) != 4 {
+		return 0, ErrInvalidLength
+	}
+	return Uint32(binary.BigEndian.Uint32(b)), nil
+}
+
+type Uint64 uint64
+
+func (ui Uint64) Marshal() ([]byte, error) {
+	b := make([]byte, 0, 8)
+	b = binary.BigEndian.AppendUint64(b, uint64(ui))
+	return b, nil
+}
+
+func (Uint64) Size() int {
+	return 8
+}
+
+func (ui Uint64) Hash(seed maphash.Seed) uint64 {
+	return hashUint64(seed, uint64(ui))
+}
+
+func (Uint64) Unmarshal(b []byte) (Uint64, error) {
+	if len(b) != 8 {
+		return 0, ErrInvalidLength
+	}
+	return Uint64(binary.BigEndian.Uint64(b)), nil
+}
+
+type String string
+
+func (str String) Marshal() ([]byte, error) {
+	return []byte(str), nil
+}
+
+func (str String) Size() int {
+	return len(str)
+}
+
+func (str String) Hash(seed maphash.Seed) uint64 {
+	return maphash.String(seed, string(str))
+}
+
+func (String) Unmarshal(b []byte) (String, error) {
+	return String(b), nil
+}
+
+func hashUint64(seed maphash.Seed, v uint64) uint64 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return maphash.Bytes(seed, b[:])
+}
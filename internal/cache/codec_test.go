@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func roundTrip[T Codec[T]](t *testing.T, v T) T {
+	t.Helper()
+
+	b, err := v.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal(%v) failed, error: %v", v, err)
+	}
+
+	var zero T
+	got, err := zero.Unmarshal(b)
+	if err != nil {
+		t.Fatalf("Unmarshal(%x) failed, error: %v", b, err)
+	}
+	return got
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	t.Run("Int", func(t *testing.T) {
+		for _, v := range []Int{0, 1, -1, 1 << 40, -1 << 62} {
+			if got := roundTrip(t, v); got != v {
+				t.Errorf("round trip of %d returned %d", v, got)
+			}
+		}
+	})
+
+	t.Run("Uint32", func(t *testing.T) {
+		for _, v := range []Uint32{0, 1, 1 << 31, ^Uint32(0)} {
+			if got := roundTrip(t, v); got != v {
+				t.Errorf("round trip of %d returned %d", v, got)
+			}
+		}
+	})
+
+	t.Run("Uint64", func(t *testing.T) {
+		for _, v := range []Uint64{0, 1, 1 << 63, ^Uint64(0)} {
+			if got := roundTrip(t, v); got != v {
+				t.Errorf("round trip of %d returned %d", v, got)
+			}
+		}
+	})
+
+	t.Run("ByteSlc", func(t *testing.T) {
+		for _, v := range []ByteSlc{{}, {0}, []byte(`{"name":"product"}`), bytes.Repeat([]byte{0xff}, 1024)} {
+			if got := roundTrip(t, v); !bytes.Equal(got, v) {
+				t.Errorf("round trip of %x returned %x", v, got)
+			}
+		}
+	})
+
+	t.Run("String", func(t *testing.T) {
+		for _, v := range []String{"", "a", "product", "продукт", "\x00\xff"} {
+			if got := roundTrip(t, v); got != v {
+				t.Errorf("round trip of %q returned %q", v, got)
+			}
+		}
+	})
+}
+
+func TestByteSlcCopies(t *testing.T) {
+	v := ByteSlc("value")
+
+	b, _ := v.Marshal()
+	b[0] = 'X'
+	if string(v) != "value" {
+		t.Errorf("Marshal shares memory with the value")
+	}
+
+	got, _ := ByteSlc(nil).Unmarshal(b)
+	b[1] = 'X'
+	if string(got) != "Xalue" {
+		t.Errorf("Unmarshal shares memory with the input")
+	}
+}
+
+func TestUnmarshalInvalidLength(t *testing.T) {
+	tests := []struct {
+		name      string
+		unmarshal func([]byte) error
+		sizes     []int
+	}{
+		{
+			name:      "Int",
+			unmarshal: func(b []byte) error { _, err := Int(0).Unmarshal(b); return err },
+			sizes:     []int{0, 4, 7, 9},
+		},
+		{
+			name:      "Uint32",
+			unmarshal: func(b []byte) error { _, err := Uint32(0).Unmarshal(b); return err },
+			sizes:     []int{0, 3, 5, 8},
+		},
+		{
+			name:      "Uint64",
+			unmarshal: func(b []byte) error { _, err := Uint64(0).Unmarshal(b); return err },
+			sizes:     []int{0, 4, 7, 9},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, size := range tt.sizes {
+				err := tt.unmarshal(make([]byte, size))
+				if !errors.Is(err, ErrInvalidLength) {
+					t.Errorf("Unmarshal of %d bytes returned %v, want %v", size, err, ErrInvalidLength)
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	data := []Data[Int, ByteSlc]{
+		{Key: 1, Value: ByteSlc("first")},
+		{Key: 2, Value: ByteSlc{}},
+		{Key: 3, Deleted: true},
+		{Key: -4, Value: bytes.Repeat([]byte("x"), 4096)},
+	}
+
+	var buf bytes.Buffer
+	enc, err := NewEncoder[Int, ByteSlc](&buf)
+	if err != nil {
+		t.Fatalf("failed to create encoder, error: %v", err)
+	}
+	for _, d := range data {
+		err = enc.Encode(d)
+		if err != nil {
+			t.Fatalf("failed to encode %v, error: %v", d.Key, err)
+		}
+	}
+	err = enc.Close()
+	if err != nil {
+		t.Fatalf("failed to close encoder, error: %v", err)
+	}
+
+	snapshot := buf.Bytes()
+
+	t.Run("complete", func(t *testing.T) {
+		dec, err := NewDecoder[Int, ByteSlc](bytes.NewReader(snapshot))
+		if err != nil {
+			t.Fatalf("failed to create decoder, error: %v", err)
+		}
+
+		for _, want := range data {
+			got, err := dec.Decode()
+			if err != nil {
+				t.Fatalf("failed to decode %v, error: %v", want.Key, err)
+			}
+			if got.Key != want.Key || got.Deleted != want.Deleted || !bytes.Equal(got.Value, want.Value) {
+				t.Errorf("decoded %v, want %v", got, want)
+			}
+		}
+
+		_, err = dec.Decode()
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("decode after the last record returned %v, want %v", err, io.EOF)
+		}
+	})
+
+	t.Run("truncated trailer", func(t *testing.T) {
+		dec, err := NewDecoder[Int, ByteSlc](bytes.NewReader(snapshot[:len(snapshot)-3]))
+		if err != nil {
+			t.Fatalf("failed to create decoder, error: %v", err)
+		}
+
+		for range data {
+			_, err = dec.Decode()
+			if err != nil {
+				t.Fatalf("failed to decode a complete record, error: %v", err)
+			}
+		}
+
+		_, err = dec.Decode()
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("decode of a truncated trailer returned %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+
+	t.Run("type mismatch", func(t *testing.T) {
+		_, err := NewDecoder[String, ByteSlc](bytes.NewReader(snapshot))
+		if !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("decoder with another key type returned %v, want %v", err, ErrTypeMismatch)
+		}
+	})
+}
@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"errors"
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CompressionNone = ""
+	CompressionZstd = "zstd"
+
+	operationCompress   = "compress"
+	operationDecompress = "decompress"
+
+	// minDictionarySamples is the least number of distinct values a dictionary is trained from,
+	// the trainer fails or panics on too few or too similar ones.
+	minDictionarySamples = 16
+)
+
+var (
+	ErrUnknownCompression = errors.New("unknown compression algorithm")
+)
+
+// compressor packs marshalled values longer than threshold with zstd. Values that do not
+// get smaller are stored as is. Once dictionarySamples distinct values are packed, a dictionary
+// trained from them is used for the following values, if training fails values keep being
+// compressed without one. Frames packed before keep
+// decoding, since the decoder handles frames with and without the dictionary.
+type compressor struct {
+	threshold         int
+	enc               atomic.Pointer[zstd.Encoder]
+	dec               atomic.Pointer[zstd.Decoder]
+	sampling          atomic.Bool
+	samplesMx         sync.Mutex
+	samples           [][]byte
+	sampled           map[uint64]struct{}
+	seed              maphash.Seed
+	dictionarySamples int
+	dictionarySize    int
+	metrics           *compressionMetrics
+}
+
+// newCompressor returns nil if cache.compression.algorithm is empty.
+func newCompressor(m *compressionMetrics) (*compressor, error) {
+	switch viper.GetString("cache.compression.algorithm") {
+	case CompressionNone:
+		return nil, nil
+	case CompressionZstd:
+	default:
+		return nil, ErrUnknownCompression
+	}
+
+	c := &compressor{
+		threshold:         viper.GetInt("cache.compression.threshold"),
+		dictionarySamples: viper.GetInt("cache.compression.dictionary-samples"),
+		sampled:           make(map[uint64]struct{}),
+		seed:              maphash.MakeSeed(),
+		dictionarySize:    int(viper.GetSizeInBytes("cache.compression.dictionary-size")),
+		metrics:           m,
+	}
+
+	err := c.setDictionary(nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.dictionarySamples > 0 {
+		c.dictionarySamples = max(c.dictionarySamples, minDictionarySamples)
+		c.sampling.Store(true)
+	}
+
+	return c, nil
+}
+
+// setDictionary replaces the decoder before the encoder, so every frame packed with d can be decoded.
+func (c *compressor) setDictionary(d []byte) error {
+	// Values are kept in memory only, a frame checksum would just make them longer.
+	encOptions := []zstd.EOption{zstd.WithEncoderCRC(false)}
+	var decOptions []zstd.DOption
+	if d != nil {
+		decOptions = append(decOptions, zstd.WithDecoderDicts(d))
+		encOptions = append(encOptions, zstd.WithEncoderDict(d))
+	}
+
+	dec, err := zstd.NewReader(nil, decOptions...)
+	if err != nil {
+		return err
+	}
+
+	enc, err := zstd.NewWriter(nil, encOptions...)
+	if err != nil {
+		return err
+	}
+
+	c.dec.Store(dec)
+	c.enc.Store(enc)
+	return nil
+}
+
+// pack returns raw compressed, false if raw is short or does not compress.
+func (c *compressor) pack(raw []byte) ([]byte, bool) {
+	if len(raw) <= c.threshold {
+		return nil, false
+	}
+	c.sample(raw)
+
+	start := time.Now()
+	packed := c.enc.Load().EncodeAll(raw, make([]byte, 0, len(raw)/2))
+	c.metrics.compressDuration.Observe(time.Since(start).Seconds())
+
+	if len(packed) >= len(raw) {
+		c.metrics.skipped.Inc()
+		return nil, false
+	}
+
+	c.metrics.inputBytes.Add(float64(len(raw)))
+	c.metrics.outputBytes.Add(float64(len(packed)))
+	c.metrics.ratio.Observe(float64(len(packed)) / float64(len(raw)))
+
+	return packed, true
+}
+
+func (c *compressor) unpack(packed []byte) ([]byte, error) {
+	start := time.Now()
+	raw, err := c.dec.Load().DecodeAll(packed, nil)
+	c.metrics.decompressDuration.Observe(time.Since(start).Seconds())
+	return raw, err
+}
+
+// sample keeps a copy of raw until enough distinct samples are collected to train the dictionary,
+// repeated values are skipped, so a value republished over and over is sampled once.
+func (c *compressor) sample(raw []byte) {
+	if !c.sampling.Load() {
+		return
+	}
+
+	c.samplesMx.Lock()
+	defer c.samplesMx.Unlock()
+
+	if !c.sampling.Load() {
+		return
+	}
+
+	h := maphash.Bytes(c.seed, raw)
+	if _, ok := c.sampled[h]; ok {
+		return
+	}
+	c.sampled[h] = struct{}{}
+
+	c.samples = append(c.samples, append([]byte(nil), raw...))
+	if len(c.samples) >= c.dictionarySamples {
+		c.sampling.Store(false)
+		go c.train(c.samples)
+		c.samples, c.sampled = nil, nil
+	}
+}
+
+// train runs in its own goroutine, so a panic of the trainer is recovered and reported as a failure.
+func (c *compressor) train(samples [][]byte) {
+	start := time.Now()
+
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Warnf("failed to train compression dictionary, compressing without it, error: %v", r)
+		}
+	}()
+
+	d, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: c.dictionarySize,
+		HashBytes:   6,
+	})
+	if err != nil {
+		logrus.Warnf("failed to train compression dictionary, compressing without it, error: %v", err)
+		return
+	}
+
+	err = c.setDictionary(d)
+	if err != nil {
+		logrus.Errorf("failed to use compression dictionary, error: %v", err)
+		return
+	}
+
+	logrus.Infof("trained %d bytes compression dictionary from %d values in %v", len(d), len(samples), time.Since(start))
+}
@@ -0,0 +1,723 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File store layout: a header of magic and version, then records of
+// crc32c | kind | key length | value length | expireAt | key | value,
+// where crc32c covers everything after it. Zero bytes follow the last record.
+const (
+	fileStoreVersion    = 1
+	fileStoreHeaderSize = 8
+	recordHeaderSize    = 4 + 1 + 4 + 4 + 8
+
+	recordPut    byte = 1
+	recordDelete byte = 2
+
+	compactFileSuffix = ".compact"
+	// compactBatchSize is how many bytes of records compaction copies per read lock.
+	compactBatchSize = 1 << 20
+)
+
+var (
+	fileStoreMagic = [4]byte{'W', 'W', 'N', 'F'}
+
+	ErrMmapUnsupported  = errors.New("memory mapped files are not supported on this platform")
+	ErrInvalidFileStore = errors.New("invalid cache file store")
+	ErrFileStoreClosed  = errors.New("cache file store is closed")
+)
+
+// fileStore persists cache entries to a memory mapped append-only file. Puts and deletes
+// are appended as records, index points to the last put of every live key, so after a
+// restart values are read straight from the mapping without decoding the whole file.
+// A torn record left by a crash and everything after it are truncated on open.
+// When the file is full it is grown, which remaps it without copying, and if at least
+// compactRatio of it is taken by overwritten, deleted or expired records, it is compacted
+// in the background. Compaction copies live records in batches of compactBatchSize bytes
+// under the read lock and takes the write lock only to swap the files, so a put or delete,
+// which runs under its bucket lock, waits for at most one batch or the swap.
+type fileStore[K Key[K]] struct {
+	mx           sync.RWMutex
+	path         string
+	file         *os.File
+	data         []byte
+	tail         int
+	index        map[K]int
+	liveBytes    int
+	minSize      int
+	compactRatio float64
+	stop         chan struct{}
+	// changed holds keys written while a compaction runs, nil if none does.
+	changed     map[K]struct{}
+	compactions sync.WaitGroup
+}
+
+type record struct {
+	kind     byte
+	key      []byte
+	value    []byte
+	expireAt int64
+	size     int
+}
+
+func openFileStore[K Key[K]](path string, minSize int, compactRatio float64, syncInterval time.Duration) (*fileStore[K], error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	// Leftover of a compaction interrupted by a crash, the store itself is intact.
+	_ = os.Remove(path + compactFileSuffix)
+
+	s := &fileStore[K]{
+		path:         path,
+		index:        make(map[K]int),
+		minSize:      max(minSize, fileStoreHeaderSize+recordHeaderSize),
+		compactRatio: compactRatio,
+		stop:         make(chan struct{}),
+	}
+
+	s.file, s.data, err = openMapped(path, s.minSize)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.load()
+	if err != nil {
+		_ = munmap(s.data)
+		_ = s.file.Close()
+		return nil, err
+	}
+
+	if s.tail > fileStoreHeaderSize && s.garbage() >= s.compactRatio {
+		s.changed = make(map[K]struct{})
+		err = s.compact()
+		if err != nil {
+			logrus.Warnf("failed to compact cache file store, error: %v", err)
+		}
+	}
+
+	if syncInterval > 0 {
+		go s.syncLoop(syncInterval)
+	}
+
+	return s, nil
+}
+
+// openMapped opens or creates path, extends it to at least minSize bytes and maps it.
+func openMapped(path string, minSize int) (*os.File, []byte, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+
+	size := int(info.Size())
+	if size < minSize {
+		size = minSize
+		err = file.Truncate(int64(size))
+		if err != nil {
+			_ = file.Close()
+			return nil, nil, err
+		}
+	}
+
+	data, err := mmap(file, size)
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+
+	return file, data, nil
+}
+
+// load checks the header of a mapped file, writing it to a new one, and rebuilds the index.
+func (s *fileStore[K]) load() error {
+	header := s.data[:fileStoreHeaderSize]
+	switch {
+	case [4]byte(header[:4]) == fileStoreMagic:
+		if binary.LittleEndian.Uint32(header[4:]) != fileStoreVersion {
+			return ErrUnsupportedVersion
+		}
+	case isZero(header):
+		copy(header, fileStoreMagic[:])
+		binary.LittleEndian.PutUint32(header[4:], fileStoreVersion)
+	default:
+		return ErrInvalidFileStore
+	}
+
+	var zero K
+	offset := fileStoreHeaderSize
+	for {
+		rec, ok, end := s.read(offset)
+		if end {
+			break
+		}
+
+		var key K
+		var err error
+		if ok {
+			key, err = zero.Unmarshal(rec.key)
+		}
+		if !ok || err != nil {
+			logrus.Warnf("truncating torn record at offset %d of cache file store %s", offset, s.path)
+			err = s.truncate(offset)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		s.apply(key, rec, offset)
+		offset += rec.size
+	}
+
+	s.tail = offset
+	logrus.Infof("opened cache file store %s with %d keys", s.path, len(s.index))
+	return nil
+}
+
+// read parses the record at offset. end is set where no more records are written,
+// ok is false for a torn or corrupted record.
+func (s *fileStore[K]) read(offset int) (rec record, ok bool, end bool) {
+	if offset+recordHeaderSize > len(s.data) {
+		return rec, false, true
+	}
+
+	header := s.data[offset : offset+recordHeaderSize]
+	if isZero(header) {
+		return rec, false, true
+	}
+
+	rec.kind = header[4]
+	keyLen := int(binary.LittleEndian.Uint32(header[5:]))
+	valueLen := int(binary.LittleEndian.Uint32(header[9:]))
+	rec.expireAt = int64(binary.LittleEndian.Uint64(header[13:]))
+	rec.size = recordHeaderSize + keyLen + valueLen
+
+	if (rec.kind != recordPut && rec.kind != recordDelete) || rec.size > len(s.data)-offset || rec.size < 0 {
+		return rec, false, false
+	}
+
+	raw := s.data[offset : offset+rec.size]
+	if binary.LittleEndian.Uint32(raw) != crc32.Checksum(raw[4:], crcTable) {
+		return rec, false, false
+	}
+
+	rec.key = raw[recordHeaderSize : recordHeaderSize+keyLen]
+	rec.value = raw[recordHeaderSize+keyLen:]
+	return rec, true, false
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// apply updates the index with the record at offset, it must be called with s.mx held.
+func (s *fileStore[K]) apply(key K, rec record, offset int) {
+	if s.changed != nil {
+		s.changed[key] = struct{}{}
+	}
+
+	if old, ok := s.index[key]; ok {
+		s.liveBytes -= s.sizeAt(old)
+		delete(s.index, key)
+	}
+
+	if rec.kind == recordPut {
+		s.index[key] = offset
+		s.liveBytes += rec.size
+	}
+}
+
+func (s *fileStore[K]) sizeAt(offset int) int {
+	return s.sizeAtIn(s.data, offset)
+}
+
+func (s *fileStore[K]) sizeAtIn(data []byte, offset int) int {
+	header := data[offset:]
+	return recordHeaderSize + int(binary.LittleEndian.Uint32(header[5:])) + int(binary.LittleEndian.Uint32(header[9:]))
+}
+
+// truncate drops everything from offset on by shrinking the file, which zeroes it when extended back.
+func (s *fileStore[K]) truncate(offset int) error {
+	size := len(s.data)
+
+	err := munmap(s.data)
+	if err != nil {
+		return err
+	}
+	s.data = nil
+
+	err = s.file.Truncate(int64(offset))
+	if err != nil {
+		return err
+	}
+	err = s.file.Truncate(int64(size))
+	if err != nil {
+		return err
+	}
+
+	s.data, err = mmap(s.file, size)
+	return err
+}
+
+func (s *fileStore[K]) put(key K, value []byte, expireAt int64) error {
+	rawByteKey, err := key.Marshal()
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.data == nil {
+		return ErrFileStoreClosed
+	}
+
+	offset, err := s.append(recordPut, rawByteKey, value, expireAt)
+	if err != nil {
+		return err
+	}
+
+	s.apply(key, record{kind: recordPut, size: recordHeaderSize + len(rawByteKey) + len(value)}, offset)
+	return nil
+}
+
+func (s *fileStore[K]) delete(key K) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.data == nil {
+		return ErrFileStoreClosed
+	}
+
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+
+	rawByteKey, err := key.Marshal()
+	if err != nil {
+		return err
+	}
+
+	offset, err := s.append(recordDelete, rawByteKey, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	s.apply(key, record{kind: recordDelete}, offset)
+	return nil
+}
+
+// append writes a record at the tail, making room for it first, and returns its offset.
+// It must be called with s.mx held.
+func (s *fileStore[K]) append(kind byte, rawByteKey, value []byte, expireAt int64) (int, error) {
+	size := recordHeaderSize + len(rawByteKey) + len(value)
+	if s.tail+size > len(s.data) {
+		err := s.makeRoom(size)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	offset := s.tail
+	raw := s.data[offset : offset+size]
+	raw[4] = kind
+	binary.LittleEndian.PutUint32(raw[5:], uint32(len(rawByteKey)))
+	binary.LittleEndian.PutUint32(raw[9:], uint32(len(value)))
+	binary.LittleEndian.PutUint64(raw[13:], uint64(expireAt))
+	copy(raw[recordHeaderSize:], rawByteKey)
+	copy(raw[recordHeaderSize+len(rawByteKey):], value)
+	binary.LittleEndian.PutUint32(raw, crc32.Checksum(raw[4:], crcTable))
+
+	s.tail += size
+	return offset, nil
+}
+
+// garbage returns the share of written records that are no longer live.
+func (s *fileStore[K]) garbage() float64 {
+	written := s.tail - fileStoreHeaderSize
+	if written <= 0 {
+		return 0
+	}
+	return 1 - float64(s.liveBytes)/float64(written)
+}
+
+// sizeFor returns a file size that fits n bytes of records twice, so the file does not fill up right away.
+func (s *fileStore[K]) sizeFor(n int) int {
+	size := s.minSize
+	for size < fileStoreHeaderSize+2*n {
+		size *= 2
+	}
+	return size
+}
+
+// makeRoom grows the file to fit size more bytes, starting a compaction if it is worth it.
+// It must be called with s.mx held.
+func (s *fileStore[K]) makeRoom(size int) error {
+	if s.changed == nil && s.garbage() >= s.compactRatio {
+		s.changed = make(map[K]struct{})
+		s.compactions.Add(1)
+		go func() {
+			defer s.compactions.Done()
+
+			err := s.compact()
+			if err != nil && !errors.Is(err, ErrFileStoreClosed) {
+				logrus.Errorf("failed to compact cache file store, error: %v", err)
+			}
+		}()
+	}
+
+	newSize := len(s.data)
+	for newSize < s.tail+size {
+		newSize *= 2
+	}
+
+	data, err := remap(s.file, s.data, newSize)
+	if err != nil {
+		return err
+	}
+	s.data = data
+	return nil
+}
+
+// remap extends file to size bytes and replaces its mapping data.
+func remap(file *os.File, data []byte, size int) ([]byte, error) {
+	err := file.Truncate(int64(size))
+	if err != nil {
+		return nil, err
+	}
+
+	newData, err := mmap(file, size)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = munmap(data)
+	return newData, nil
+}
+
+// compact copies the live records into a new file and replaces the store file with it,
+// s.changed must be set before. Records written before the compaction started are copied
+// in batches under the read lock, keys written since are copied again under the write lock
+// right before the swap, so writers wait for a single batch or the swap at most.
+func (s *fileStore[K]) compact() error {
+	start := time.Now()
+	compactPath := s.path + compactFileSuffix
+
+	s.mx.RLock()
+	end, size := s.tail, s.sizeFor(s.liveBytes)
+	s.mx.RUnlock()
+
+	_ = os.Remove(compactPath)
+	file, data, err := openMapped(compactPath, size)
+	if err != nil {
+		s.endCompaction()
+		return err
+	}
+
+	abort := func(err error) error {
+		_ = munmap(data)
+		_ = file.Close()
+		_ = os.Remove(compactPath)
+		s.endCompaction()
+		return err
+	}
+
+	copy(data, fileStoreMagic[:])
+	binary.LittleEndian.PutUint32(data[4:], fileStoreVersion)
+
+	var zero K
+	index := make(map[K]int)
+	written := fileStoreHeaderSize
+
+	// copyRecord appends the record at offset of the store to the new file.
+	copyRecord := func(key K, offset, recordSize int) error {
+		if written+recordSize > len(data) {
+			newSize := len(data)
+			for newSize < written+recordSize {
+				newSize *= 2
+			}
+			newData, err := remap(file, data, newSize)
+			if err != nil {
+				return err
+			}
+			data = newData
+		}
+
+		copy(data[written:], s.data[offset:offset+recordSize])
+		index[key] = written
+		written += recordSize
+		return nil
+	}
+
+	for offset := fileStoreHeaderSize; offset < end; {
+		select {
+		case <-s.stop:
+			return abort(ErrFileStoreClosed)
+		default:
+		}
+
+		s.mx.RLock()
+		now := time.Now().UnixNano()
+		for batchEnd := min(end, offset+compactBatchSize); offset < batchEnd; {
+			rec, ok, atEnd := s.read(offset)
+			if !ok || atEnd {
+				// Records before tail were all read on open or appended since,
+				// so this is a corruption and the old file is kept.
+				s.mx.RUnlock()
+				return abort(ErrInvalidFileStore)
+			}
+			key, err := zero.Unmarshal(rec.key)
+			if err == nil && rec.kind == recordPut && s.index[key] == offset && (rec.expireAt == 0 || rec.expireAt > now) {
+				err = copyRecord(key, offset, rec.size)
+				if err != nil {
+					s.mx.RUnlock()
+					return abort(err)
+				}
+			}
+			offset += rec.size
+		}
+		s.mx.RUnlock()
+	}
+
+	err = msync(data[:written])
+	if err != nil {
+		return abort(err)
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.data == nil {
+		return abort(ErrFileStoreClosed)
+	}
+
+	garbage := 0
+	for key := range s.changed {
+		if offset, ok := index[key]; ok {
+			garbage += s.sizeAtIn(data, offset)
+			delete(index, key)
+		}
+
+		offset, ok := s.index[key]
+		if !ok {
+			continue
+		}
+
+		err = copyRecord(key, offset, s.sizeAt(offset))
+		if err != nil {
+			return abort(err)
+		}
+	}
+
+	err = msync(data[:written])
+	if err != nil {
+		return abort(err)
+	}
+
+	err = os.Rename(compactPath, s.path)
+	if err != nil {
+		return abort(err)
+	}
+
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+
+	_ = munmap(s.data)
+	_ = s.file.Close()
+
+	previous := s.tail
+	s.file, s.data, s.index = file, data, index
+	s.tail = written
+	s.liveBytes = written - fileStoreHeaderSize - garbage
+	s.changed = nil
+
+	logrus.Infof("compacted cache file store %s from %d to %d bytes in %v", s.path, previous, written, time.Since(start))
+	return nil
+}
+
+func (s *fileStore[K]) endCompaction() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.changed = nil
+}
+
+// get returns a copy of the value of key and its expiration time.
+func (s *fileStore[K]) get(key K) ([]byte, int64, bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	offset, ok := s.index[key]
+	if !ok || s.data == nil {
+		return nil, 0, false
+	}
+
+	rec, ok, _ := s.read(offset)
+	if !ok || (rec.expireAt != 0 && rec.expireAt <= time.Now().UnixNano()) {
+		return nil, 0, false
+	}
+
+	return append([]byte(nil), rec.value...), rec.expireAt, true
+}
+
+func (s *fileStore[K]) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mx.RLock()
+			if s.data == nil {
+				s.mx.RUnlock()
+				return
+			}
+			err := msync(s.data[:s.tail])
+			s.mx.RUnlock()
+			if err != nil {
+				logrus.Errorf("failed to sync cache file store, error: %v", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *fileStore[K]) close() error {
+	close(s.stop)
+	s.compactions.Wait()
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	err := msync(s.data)
+	if err != nil {
+		return err
+	}
+
+	err = munmap(s.data)
+	if err != nil {
+		return err
+	}
+	s.data = nil
+
+	return s.file.Close()
+}
+
+// persist writes item to the file store, it must be called with c.mx held.
+func (c *bucket[K, V]) persist(key K, item Item[K, V]) {
+	if c.store == nil {
+		return
+	}
+
+	raw, err := c.marshalled(item)
+	if err == nil {
+		err = c.store.put(key, raw, item.expireAt)
+	}
+	if err != nil {
+		logrus.Errorf("failed to persist cache value, error: %v", err)
+	}
+}
+
+// unpersist deletes key from the file store, it must be called with c.mx held.
+func (c *bucket[K, V]) unpersist(key K) {
+	if c.store == nil {
+		return
+	}
+
+	err := c.store.delete(key)
+	if err != nil {
+		logrus.Errorf("failed to delete persisted cache value, error: %v", err)
+	}
+}
+
+// promote moves the stored value of key into memory without writing it back.
+func (c *bucket[K, V]) promote(key K) (Item[K, V], bool) {
+	c.lock()
+	defer c.unlock()
+
+	if item, ok := c.items[key]; ok {
+		return c.detach(item), !item.expired(time.Now().UnixNano())
+	}
+
+	raw, expireAt, ok := c.store.get(key)
+	if !ok {
+		return Item[K, V]{}, false
+	}
+
+	var zero V
+	value, err := zero.Unmarshal(raw)
+	if err != nil {
+		logrus.Errorf("failed to unmarshal persisted cache value, error: %v", err)
+		return Item[K, V]{}, false
+	}
+
+	item := newItem[K](c.compressor, c.arena != nil, value, expireAt)
+	if c.arena != nil {
+		c.insert(key, c.arenaStore(key, item))
+	} else {
+		c.insert(key, item)
+	}
+	return item, true
+}
+
+// promoteMany promotes missing[start:] and returns missing without the keys found.
+func (c *bucket[K, V]) promoteMany(missing []K, start int, found map[K]V) []K {
+	keys := missing[start:]
+	missing = missing[:start]
+
+	for _, key := range keys {
+		item, ok := c.promote(key)
+		if ok && !item.negative {
+			var value V
+			value, ok = c.valueOrMiss(item)
+			if ok {
+				found[key] = value
+				continue
+			}
+		}
+		missing = append(missing, key)
+	}
+
+	return missing
+}
+
+// Persistent reports whether values are written through to the file store, so they
+// survive a restart without backups. Stored values are moved into memory on first read,
+// until then they are not counted by Len nor written to snapshots, and their versions
+// are not kept. Values keep their expiration time in the file, so with cache.ttl of 10m
+// a store reopened more than 10 minutes after the last writes serves no hits.
+func (c *Cache[K, V]) Persistent() bool {
+	return c.store != nil
+}
+
+// Close flushes and closes the file store, values are no longer persisted after it.
+func (c *Cache[K, V]) Close() error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.close()
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+
+	s, err := openFileStore[Int](path, 4096, 0.5, 0)
+	if err != nil {
+		t.Fatalf("failed to open store, error: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		for round := 0; round < 3; round++ {
+			err = s.put(Int(i), []byte(fmt.Sprintf("%d-%d", i, round)), 0)
+			if err != nil {
+				t.Fatalf("failed to put, error: %v", err)
+			}
+		}
+	}
+	for i := 0; i < 10; i++ {
+		err = s.delete(Int(i))
+		if err != nil {
+			t.Fatalf("failed to delete, error: %v", err)
+		}
+	}
+	tail := s.tail
+	err = s.close()
+	if err != nil {
+		t.Fatalf("failed to close store, error: %v", err)
+	}
+
+	// A record torn by a crash: a header without a matching body.
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open store file, error: %v", err)
+	}
+	_, err = file.WriteAt([]byte{1, 2, 3, 4, recordPut, 8, 0, 0, 0, 16}, int64(tail))
+	_ = file.Close()
+	if err != nil {
+		t.Fatalf("failed to write torn record, error: %v", err)
+	}
+
+	s, err = openFileStore[Int](path, 4096, 0.5, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen store, error: %v", err)
+	}
+	defer func() { _ = s.close() }()
+
+	for i := 0; i < 100; i++ {
+		value, _, ok := s.get(Int(i))
+		if i < 10 {
+			if ok {
+				t.Errorf("deleted key %d found", i)
+			}
+			continue
+		}
+		if want := fmt.Sprintf("%d-2", i); !ok || string(value) != want {
+			t.Errorf("key %d returned %q, %v, want %q", i, value, ok, want)
+		}
+	}
+
+	if s.tail >= tail {
+		t.Errorf("reopened store tail is %d, want it compacted below %d", s.tail, tail)
+	}
+}
+
+func TestFileStoreCompactionWithWriters(t *testing.T) {
+	const (
+		writers = 8
+		keys    = 200
+		rounds  = 20
+	)
+
+	s, err := openFileStore[Int](filepath.Join(t.TempDir(), "store"), 4096, 0.5, 0)
+	if err != nil {
+		t.Fatalf("failed to open store, error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				for i := w; i < keys; i += writers {
+					if i%5 == 0 && round == rounds-1 {
+						_ = s.delete(Int(i))
+						continue
+					}
+					_ = s.put(Int(i), []byte(fmt.Sprintf("%d-%d", i, round)), 0)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	s.compactions.Wait()
+
+	for i := 0; i < keys; i++ {
+		value, _, ok := s.get(Int(i))
+		if i%5 == 0 {
+			if ok {
+				t.Errorf("deleted key %d found", i)
+			}
+			continue
+		}
+		if want := fmt.Sprintf("%d-%d", i, rounds-1); !ok || string(value) != want {
+			t.Errorf("key %d returned %q, %v, want %q", i, value, ok, want)
+		}
+	}
+
+	err = s.close()
+	if err != nil {
+		t.Fatalf("failed to close store, error: %v", err)
+	}
+}
+
+// TestFileStoreCompactionCorruption zeroes a record header, which read reports as the end
+// of the file, so compaction would never move past it.
+func TestFileStoreCompactionCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store")
+
+	s, err := openFileStore[Int](path, 4096, 2, 0)
+	if err != nil {
+		t.Fatalf("failed to open store, error: %v", err)
+	}
+	defer func() { _ = s.close() }()
+
+	for i := 0; i < 10; i++ {
+		err = s.put(Int(i), []byte(fmt.Sprintf("%d", i)), 0)
+		if err != nil {
+			t.Fatalf("failed to put, error: %v", err)
+		}
+	}
+
+	s.mx.Lock()
+	clear(s.data[s.index[5] : s.index[5]+recordHeaderSize])
+	s.changed = make(map[Int]struct{})
+	s.mx.Unlock()
+
+	done := make(chan error)
+	go func() { done <- s.compact() }()
+
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("compaction of a corrupted file did not finish")
+	}
+	if !errors.Is(err, ErrInvalidFileStore) {
+		t.Errorf("compaction returned %v, want %v", err, ErrInvalidFileStore)
+	}
+	if s.changed != nil {
+		t.Errorf("aborted compaction is still marked as running")
+	}
+	if _, err = os.Stat(path + compactFileSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("aborted compaction left its file, error: %v", err)
+	}
+	if value, _, ok := s.get(Int(9)); !ok || string(value) != "9" {
+		t.Errorf("key 9 returned %q, %v after the aborted compaction", value, ok)
+	}
+}
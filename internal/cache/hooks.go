@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type RemoveReason int
+
+const (
+	// ReasonCapacity means the item was evicted to satisfy the elements threshold or the bytes budget.
+	ReasonCapacity RemoveReason = iota
+	// ReasonExpired means the item outlived its ttl.
+	ReasonExpired
+	// ReasonDeleted means the item was removed by Delete or Clear.
+	ReasonDeleted
+	// ReasonReplaced means the item was overwritten by a put of the same key.
+	ReasonReplaced
+)
+
+func (r RemoveReason) String() string {
+	switch r {
+	case ReasonCapacity:
+		return "capacity"
+	case ReasonExpired:
+		return "expired"
+	case ReasonDeleted:
+		return "deleted"
+	case ReasonReplaced:
+		return "replaced"
+	default:
+		return "unknown"
+	}
+}
+
+// RemoveFunc is called after the bucket lock is released, so it may use the cache.
+type RemoveFunc[K Key[K], V Codec[V]] func(key K, value V, reason RemoveReason)
+
+type removal[K Key[K], V Codec[V]] struct {
+	key    K
+	item   Item[K, V]
+	reason RemoveReason
+}
+
+type hooks[K Key[K], V Codec[V]] struct {
+	mx       sync.RWMutex
+	set      atomic.Bool
+	onEvict  []RemoveFunc[K, V]
+	onRemove []RemoveFunc[K, V]
+}
+
+// run calls the hooks for removed items, value decompresses an item, values that fail to are skipped.
+func (h *hooks[K, V]) run(removed []removal[K, V], value func(Item[K, V]) (V, bool)) {
+	if len(removed) == 0 {
+		return
+	}
+
+	h.mx.RLock()
+	onEvict, onRemove := h.onEvict, h.onRemove
+	h.mx.RUnlock()
+
+	for _, r := range removed {
+		v, ok := value(r.item)
+		if !ok {
+			continue
+		}
+
+		if r.reason == ReasonCapacity || r.reason == ReasonExpired {
+			for _, fn := range onEvict {
+				fn(r.key, v, r.reason)
+			}
+		}
+
+		for _, fn := range onRemove {
+			fn(r.key, v, r.reason)
+		}
+	}
+}
+
+// OnEvict registers fn to be called for items the cache removed by itself, because of capacity or ttl.
+func (c *Cache[K, V]) OnEvict(fn RemoveFunc[K, V]) {
+	c.hooks.mx.Lock()
+	defer c.hooks.mx.Unlock()
+
+	c.hooks.onEvict = append(c.hooks.onEvict, fn)
+	c.hooks.set.Store(true)
+}
+
+// OnRemove registers fn to be called for every removed or overwritten item, whatever the reason.
+func (c *Cache[K, V]) OnRemove(fn RemoveFunc[K, V]) {
+	c.hooks.mx.Lock()
+	defer c.hooks.mx.Unlock()
+
+	c.hooks.onRemove = append(c.hooks.onRemove, fn)
+	c.hooks.set.Store(true)
+}
+
+// record queues a removed value for the hooks, it must be called with c.mx held.
+func (c *bucket[K, V]) record(key K, item Item[K, V], reason RemoveReason) {
+	if item.negative || !c.hooks.set.Load() {
+		return
+	}
+	c.removed = append(c.removed, removal[K, V]{key: key, item: c.detach(item), reason: reason})
+}
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+type removedValue struct {
+	key    Int
+	value  string
+	reason RemoveReason
+}
+
+// recorder collects the values passed to the hooks, which run in the cleaner and sweeper goroutines as well.
+type recorder struct {
+	mx      sync.Mutex
+	evicted []removedValue
+	removed []removedValue
+}
+
+func newRecorder(c *Cache[Int, ByteSlc]) *recorder {
+	r := &recorder{}
+	c.OnEvict(func(key Int, value ByteSlc, reason RemoveReason) {
+		r.mx.Lock()
+		defer r.mx.Unlock()
+		r.evicted = append(r.evicted, removedValue{key: key, value: string(value), reason: reason})
+	})
+	c.OnRemove(func(key Int, value ByteSlc, reason RemoveReason) {
+		r.mx.Lock()
+		defer r.mx.Unlock()
+		r.removed = append(r.removed, removedValue{key: key, value: string(value), reason: reason})
+	})
+	return r
+}
+
+func (r *recorder) values() ([]removedValue, []removedValue) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]removedValue(nil), r.evicted...), append([]removedValue(nil), r.removed...)
+}
+
+// wait polls until the hooks got want removals, for removals made in background goroutines.
+func (r *recorder) wait(t *testing.T, want int) ([]removedValue, []removedValue) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		evicted, removed := r.values()
+		if len(removed) >= want || time.Now().After(deadline) {
+			return evicted, removed
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHooksReasons(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides map[string]any
+		// act removes key 1 holding "value", the other keys hold their number.
+		act     func(c *Cache[Int, ByteSlc])
+		reason  RemoveReason
+		evicted bool
+	}{
+		{
+			name: "replaced",
+			act: func(c *Cache[Int, ByteSlc]) {
+				c.PutKey(1, ByteSlc("other"))
+			},
+			reason: ReasonReplaced,
+		},
+		{
+			name: "deleted",
+			act: func(c *Cache[Int, ByteSlc]) {
+				c.Delete(1)
+			},
+			reason: ReasonDeleted,
+		},
+		{
+			name:      "expired on get",
+			overrides: map[string]any{"cache.ttl": 20 * time.Millisecond},
+			act: func(c *Cache[Int, ByteSlc]) {
+				time.Sleep(30 * time.Millisecond)
+				c.Get(1)
+			},
+			reason:  ReasonExpired,
+			evicted: true,
+		},
+		{
+			name: "expired on sweep",
+			overrides: map[string]any{
+				"cache.ttl":                20 * time.Millisecond,
+				"cache.ttl-sweep-interval": 10 * time.Millisecond,
+			},
+			act: func(c *Cache[Int, ByteSlc]) {
+				time.Sleep(50 * time.Millisecond)
+			},
+			reason:  ReasonExpired,
+			evicted: true,
+		},
+		{
+			name: "capacity of the bytes budget",
+			overrides: map[string]any{
+				"cache.buckets-amount": 1,
+				"cache.max-bytes":      7,
+			},
+			act: func(c *Cache[Int, ByteSlc]) {
+				c.PutKey(2, ByteSlc("2"))
+				c.PutKey(3, ByteSlc("3"))
+				c.PutKey(4, ByteSlc("4"))
+			},
+			reason:  ReasonCapacity,
+			evicted: true,
+		},
+		{
+			name: "capacity of the elements threshold",
+			overrides: map[string]any{
+				"cache.buckets-amount":            1,
+				"cache.elems.threshold":           3,
+				"cache.elems.remains-after-clean": 2,
+			},
+			act: func(c *Cache[Int, ByteSlc]) {
+				c.PutKey(2, ByteSlc("2"))
+				c.PutKey(3, ByteSlc("3"))
+			},
+			reason:  ReasonCapacity,
+			evicted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache[Int, ByteSlc](t, tt.overrides)
+			r := newRecorder(c)
+
+			c.PutKey(1, ByteSlc("value"))
+			tt.act(c)
+
+			evicted, removed := r.wait(t, 1)
+			want := removedValue{key: 1, value: "value", reason: tt.reason}
+			if len(removed) != 1 || removed[0] != want {
+				t.Errorf("OnRemove got %v, want %v", removed, want)
+			}
+
+			if tt.evicted {
+				if len(evicted) != 1 || evicted[0] != want {
+					t.Errorf("OnEvict got %v, want %v", evicted, want)
+				}
+			} else if len(evicted) != 0 {
+				t.Errorf("OnEvict got %v for %v", evicted, tt.reason)
+			}
+		})
+	}
+}
+
+func TestHooksClear(t *testing.T) {
+	c := newTestCache[Int, ByteSlc](t, nil)
+	r := newRecorder(c)
+
+	c.PutKey(1, ByteSlc("1"))
+	c.PutKey(2, ByteSlc("2"))
+	_, _ = c.GetOrLoad(3, func(Int) (ByteSlc, error) { return nil, ErrNotFound })
+	c.Clear()
+
+	evicted, removed := r.values()
+	if len(evicted) != 0 {
+		t.Errorf("OnEvict got %v for clear", evicted)
+	}
+
+	// Negative results hold no value, so the hooks do not get them.
+	got := make(map[Int]removedValue)
+	for _, v := range removed {
+		got[v.key] = v
+	}
+	if len(removed) != 2 || got[1].value != "1" || got[2].value != "2" || got[1].reason != ReasonDeleted || got[2].reason != ReasonDeleted {
+		t.Errorf("OnRemove got %v, want keys 1 and 2 deleted", removed)
+	}
+}
+
+func TestHooksCompressedValues(t *testing.T) {
+	c := newTestCache[Int, ByteSlc](t, map[string]any{
+		"cache.compression.algorithm":          CompressionZstd,
+		"cache.compression.threshold":          16,
+		"cache.compression.dictionary-samples": 0,
+	})
+	r := newRecorder(c)
+
+	value := bytes.Repeat([]byte("product "), 64)
+	c.PutKey(1, value)
+	if item := c.bucketFor(1).items[1]; item.packed == nil {
+		t.Fatalf("value was not compressed")
+	}
+
+	c.PutKey(1, ByteSlc("short"))
+	c.Delete(1)
+
+	_, removed := r.values()
+	want := []removedValue{
+		{key: 1, value: string(value), reason: ReasonReplaced},
+		{key: 1, value: "short", reason: ReasonDeleted},
+	}
+	if len(removed) != len(want) || removed[0] != want[0] || removed[1] != want[1] {
+		t.Errorf("OnRemove got %v, want the decompressed values", removed)
+	}
+}
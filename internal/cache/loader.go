@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by a loader passed to GetOrLoad when the key does not exist in the source.
+	ErrNotFound = errors.New("key not found")
+)
+
+type call[V any] struct {
+	wg    sync.WaitGroup
+	value V
+	err   error
+}
+
+// group runs one function per key at a time, concurrent callers with the same key wait for its result.
+type group[K comparable, V any] struct {
+	mx    sync.Mutex
+	calls map[K]*call[V]
+}
+
+func (g *group[K, V]) do(key K, fn func() (V, error)) (V, error) {
+	g.mx.Lock()
+	if cl, ok := g.calls[key]; ok {
+		g.mx.Unlock()
+		cl.wg.Wait()
+		return cl.value, cl.err
+	}
+
+	cl := &call[V]{}
+	cl.wg.Add(1)
+	g.calls[key] = cl
+	g.mx.Unlock()
+
+	defer func() {
+		g.mx.Lock()
+		delete(g.calls, key)
+		g.mx.Unlock()
+		cl.wg.Done()
+	}()
+
+	cl.value, cl.err = fn()
+	return cl.value, cl.err
+}
+
+// GetOrLoad returns the cached value of key or calls loader on a miss and caches its result.
+// Concurrent misses of the same key share a single loader call. If loader returns
+// an error wrapping ErrNotFound, the miss is remembered for cache.negative-ttl and
+// later calls return ErrNotFound without calling loader. Neither the loaded value nor
+// the miss replaces a value put while loader was running, nor is cached if the key was
+// deleted while loader was running, since loader may have read the data before the change.
+func (c *Cache[K, V]) GetOrLoad(key K, loader func(K) (V, error)) (V, error) {
+	b := c.bucketFor(key)
+
+	value, ok, err := b.lookup(key)
+	if ok {
+		b.metrics.hits.Inc()
+		return value, err
+	}
+	b.metrics.misses.Inc()
+
+	return c.loads.do(key, func() (V, error) {
+		value, ok, err := b.lookup(key)
+		if ok {
+			return value, err
+		}
+
+		start := time.Now().UnixNano()
+		// A value written or a delete while loader was running is newer than the loaded value.
+		accept := func(_ uint64, ok bool) bool {
+			return !ok && !b.deletedSince(key, start)
+		}
+
+		value, err = loader(key)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) && c.negativeTTL > 0 {
+				b.putIf(key, Item[K, V]{
+					negative: true,
+					expireAt: time.Now().Add(c.negativeTTL).UnixNano(),
+				}, accept)
+			}
+			return value, err
+		}
+
+		b.putIf(key, c.newItem(value, expireAtFor(c.ttl)), accept)
+		return value, nil
+	})
+}
+
+// lookup reports whether key is cached, either with a value or as a negative result.
+func (c *bucket[K, V]) lookup(key K) (V, bool, error) {
+	item, ok := c.get(key)
+	if !ok {
+		return item.Data, false, nil
+	}
+
+	if item.negative {
+		return item.Data, true, ErrNotFound
+	}
+
+	value, ok := c.valueOrMiss(item)
+	return value, ok, nil
+}
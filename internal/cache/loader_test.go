@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetOrLoadCoalescesMisses(t *testing.T) {
+	const callers = 64
+
+	c := newTestCache[Int, ByteSlc](t, nil)
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	loader := func(Int) (ByteSlc, error) {
+		calls.Add(1)
+		<-release
+		return ByteSlc("loaded"), nil
+	}
+
+	var wg sync.WaitGroup
+	var started sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			value, err := c.GetOrLoad(1, loader)
+			if err != nil || string(value) != "loaded" {
+				errs <- errors.New("caller got " + string(value))
+			}
+		}()
+	}
+
+	// Let every caller reach the loader call before it returns.
+	started.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("loader was called %d times, want 1", calls.Load())
+	}
+
+	if _, err := c.GetOrLoad(1, loader); err != nil || calls.Load() != 1 {
+		t.Errorf("load of a cached key called the loader, error: %v", err)
+	}
+}
+
+func TestGetOrLoadCachesNegativeResults(t *testing.T) {
+	const negativeTTL = 100 * time.Millisecond
+
+	c := newTestCache[Int, ByteSlc](t, map[string]any{"cache.negative-ttl": negativeTTL})
+
+	var calls atomic.Int32
+	loader := func(Int) (ByteSlc, error) {
+		calls.Add(1)
+		return nil, ErrNotFound
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := c.GetOrLoad(1, loader)
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("load of a missing key returned %v, want %v", err, ErrNotFound)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("loader was called %d times within the negative ttl, want 1", calls.Load())
+	}
+	if _, ok := c.Get(1); ok || c.Len() != 0 {
+		t.Errorf("negative result is counted as a cached value")
+	}
+
+	time.Sleep(negativeTTL + 20*time.Millisecond)
+	_, err := c.GetOrLoad(1, loader)
+	if !errors.Is(err, ErrNotFound) || calls.Load() != 2 {
+		t.Errorf("load after the negative ttl returned %v with %d loader calls, want a second call", err, calls.Load())
+	}
+
+	// Other errors are not cached.
+	failure := errors.New("database is unavailable")
+	for i := 0; i < 2; i++ {
+		_, err = c.GetOrLoad(2, func(Int) (ByteSlc, error) {
+			calls.Add(1)
+			return nil, failure
+		})
+		if !errors.Is(err, failure) {
+			t.Errorf("load returned %v, want %v", err, failure)
+		}
+	}
+	if calls.Load() != 4 {
+		t.Errorf("failed load was cached")
+	}
+
+	// A value put later replaces the negative result.
+	c.PutKey(1, ByteSlc("inserted"))
+	value, err := c.GetOrLoad(1, loader)
+	if err != nil || string(value) != "inserted" {
+		t.Errorf("got %q, %v after a put, want the put value", value, err)
+	}
+}
+
+func TestGetOrLoadWithoutNegativeTTL(t *testing.T) {
+	c := newTestCache[Int, ByteSlc](t, nil)
+
+	var calls atomic.Int32
+	for i := 0; i < 3; i++ {
+		_, _ = c.GetOrLoad(1, func(Int) (ByteSlc, error) {
+			calls.Add(1)
+			return nil, ErrNotFound
+		})
+	}
+	if calls.Load() != 3 {
+		t.Errorf("loader was called %d times without a negative ttl, want 3", calls.Load())
+	}
+}
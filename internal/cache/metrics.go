@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"time"
+)
+
+const (
+	cleanerThreshold = "threshold"
+	cleanerSweep     = "sweep"
+)
+
+type metrics struct {
+	hits          prometheus.Counter
+	misses        prometheus.Counter
+	puts          prometheus.Counter
+	expired       *prometheus.CounterVec
+	removed       *prometheus.CounterVec
+	entries       *prometheus.GaugeVec
+	bytes         *prometheus.GaugeVec
+	cleanDuration *prometheus.HistogramVec
+	lockWait      prometheus.Histogram
+}
+
+func newMetrics(name string, reg prometheus.Registerer) *metrics {
+	labels := prometheus.Labels{"cache": name}
+
+	m := &metrics{
+		hits: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_hits_total",
+				Help:        "number of cache lookups that found a value",
+				ConstLabels: labels,
+			}),
+
+		misses: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_misses_total",
+				Help:        "number of cache lookups that found nothing",
+				ConstLabels: labels,
+			}),
+
+		puts: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_puts_total",
+				Help:        "number of values put into the cache",
+				ConstLabels: labels,
+			}),
+
+		expired: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_expired_entries_total",
+				Help:        "number of cache entries removed after their ttl expired",
+				ConstLabels: labels,
+			}, []string{"trigger"}),
+
+		removed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_removed_entries_total",
+				Help:        "number of cache entries removed or overwritten, by reason",
+				ConstLabels: labels,
+			}, []string{"reason"}),
+
+		entries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_entries",
+				Help:        "number of cached values per bucket",
+				ConstLabels: labels,
+			}, []string{"bucket"}),
+
+		bytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_bytes",
+				Help:        "total size of cached values in bytes per bucket",
+				ConstLabels: labels,
+			}, []string{"bucket"}),
+
+		cleanDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_cleaner_duration_seconds",
+				Help:        "how long a run of a bucket cleaner takes",
+				ConstLabels: labels,
+				Buckets:     prometheus.ExponentialBuckets(0.00001, 4, 10),
+			}, []string{"cleaner"}),
+
+		lockWait: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_lock_wait_seconds",
+				Help:        "how long acquiring a bucket lock takes",
+				ConstLabels: labels,
+				Buckets:     prometheus.ExponentialBuckets(0.000001, 4, 10),
+			}),
+	}
+
+	reg.MustRegister(m.hits, m.misses, m.puts, m.expired, m.removed, m.entries, m.bytes, m.cleanDuration, m.lockWait)
+	return m
+}
+
+// bucketMetrics holds the children of metrics used by a single bucket, resolved once
+// so the hot path does not look up label values.
+type bucketMetrics struct {
+	*metrics
+	bucketEntries  prometheus.Gauge
+	bucketBytes    prometheus.Gauge
+	removedBy      [ReasonReplaced + 1]prometheus.Counter
+	expiredOnGet   prometheus.Counter
+	expiredOnSweep prometheus.Counter
+}
+
+func (m *metrics) forBucket(index int) *bucketMetrics {
+	bucket := strconv.Itoa(index)
+
+	bm := &bucketMetrics{
+		metrics:        m,
+		bucketEntries:  m.entries.WithLabelValues(bucket),
+		bucketBytes:    m.bytes.WithLabelValues(bucket),
+		expiredOnGet:   m.expired.WithLabelValues(triggerGet),
+		expiredOnSweep: m.expired.WithLabelValues(triggerSweep),
+	}
+
+	for reason := range bm.removedBy {
+		bm.removedBy[reason] = m.removed.WithLabelValues(RemoveReason(reason).String())
+	}
+
+	return bm
+}
+
+func (m *bucketMetrics) observeClean(cleaner string, start time.Time) {
+	m.cleanDuration.WithLabelValues(cleaner).Observe(time.Since(start).Seconds())
+}
+
+type compressionMetrics struct {
+	inputBytes         prometheus.Counter
+	outputBytes        prometheus.Counter
+	skipped            prometheus.Counter
+	ratio              prometheus.Histogram
+	compressDuration   prometheus.Observer
+	decompressDuration prometheus.Observer
+}
+
+func newCompressionMetrics(name string, reg prometheus.Registerer) *compressionMetrics {
+	labels := prometheus.Labels{"cache": name}
+
+	duration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   "TestTaskNatsApp",
+			Name:        "cache_compression_duration_seconds",
+			Help:        "how long compressing or decompressing a cached value takes",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.000001, 4, 10),
+		}, []string{"operation"})
+
+	m := &compressionMetrics{
+		inputBytes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_compression_input_bytes_total",
+				Help:        "size of compressed cache values before compression",
+				ConstLabels: labels,
+			}),
+
+		outputBytes: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_compression_output_bytes_total",
+				Help:        "size of compressed cache values after compression",
+				ConstLabels: labels,
+			}),
+
+		skipped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_compression_skipped_total",
+				Help:        "number of cache values stored uncompressed because compression did not make them smaller",
+				ConstLabels: labels,
+			}),
+
+		ratio: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace:   "TestTaskNatsApp",
+				Name:        "cache_compression_ratio",
+				Help:        "compressed size of a cache value divided by its original size",
+				ConstLabels: labels,
+				Buckets:     prometheus.LinearBuckets(0.1, 0.1, 10),
+			}),
+
+		compressDuration:   duration.WithLabelValues(operationCompress),
+		decompressDuration: duration.WithLabelValues(operationDecompress),
+	}
+
+	reg.MustRegister(m.inputBytes, m.outputBytes, m.skipped, m.ratio, duration)
+	return m
+}
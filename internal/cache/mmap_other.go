@@ -0,0 +1,19 @@
+//go:build !unix
+
+package cache
+
+import (
+	"os"
+)
+
+func mmap(*os.File, int) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmap([]byte) error {
+	return ErrMmapUnsupported
+}
+
+func msync([]byte) error {
+	return ErrMmapUnsupported
+}
@@ -0,0 +1,323 @@
+package cache
+
+import (
+	"container/heap"
+	"errors"
+	"github.com/PrettyPepeBoy/WorkWithNats/pkg/list"
+)
+
+const (
+	PolicyLRU = "lru"
+	PolicyLFU = "lfu"
+	Policy2Q  = "2q"
+)
+
+var (
+	ErrUnknownPolicy = errors.New("unknown eviction policy")
+)
+
+// lfuAgingFactor times the capacity is the number of accesses after which the lfu policy
+// halves all frequencies.
+const lfuAgingFactor = 10
+
+// EvictionPolicy decides which key of a bucket is evicted next.
+// Methods are called with the bucket lock held, so implementations need no locking.
+type EvictionPolicy[K comparable] interface {
+	// Add records a key inserted into the bucket.
+	Add(key K)
+	// Access records a hit or an overwrite of a resident key.
+	Access(key K)
+	// Evict forgets a key the bucket evicted to make room, usually the one returned by Victim.
+	Evict(key K)
+	// Remove forgets a key deleted, expired or dropped from the bucket for any other reason.
+	Remove(key K)
+	// Victim returns the resident key to evict, false if there is none.
+	Victim() (K, bool)
+}
+
+// newPolicyFactory returns a constructor of the named policy for buckets holding about capacity keys.
+func newPolicyFactory[K comparable](name string, capacity int) (func() EvictionPolicy[K], error) {
+	switch name {
+	case PolicyLRU, "":
+		return func() EvictionPolicy[K] { return newLRUPolicy[K]() }, nil
+	case PolicyLFU:
+		return func() EvictionPolicy[K] { return newLFUPolicy[K](capacity) }, nil
+	case Policy2Q:
+		return func() EvictionPolicy[K] { return newTwoQueuePolicy[K](capacity) }, nil
+	default:
+		return nil, ErrUnknownPolicy
+	}
+}
+
+type lruPolicy[K comparable] struct {
+	list     *list.List[K]
+	elements map[K]*list.Element[K]
+}
+
+func newLRUPolicy[K comparable]() *lruPolicy[K] {
+	return &lruPolicy[K]{
+		list:     list.NewList[K](),
+		elements: make(map[K]*list.Element[K]),
+	}
+}
+
+func (p *lruPolicy[K]) Add(key K) {
+	if e, ok := p.elements[key]; ok {
+		p.list.MoveToBack(e)
+		return
+	}
+	p.elements[key] = p.list.Put(&list.Element[K]{Value: key})
+}
+
+func (p *lruPolicy[K]) Access(key K) {
+	if e, ok := p.elements[key]; ok {
+		p.list.MoveToBack(e)
+	}
+}
+
+func (p *lruPolicy[K]) Evict(key K) {
+	p.Remove(key)
+}
+
+func (p *lruPolicy[K]) Remove(key K) {
+	if e, ok := p.elements[key]; ok {
+		p.list.Remove(e)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lruPolicy[K]) Victim() (K, bool) {
+	e := p.list.Front()
+	if e == nil {
+		var zero K
+		return zero, false
+	}
+	return e.Value, true
+}
+
+type lfuEntry[K comparable] struct {
+	key   K
+	freq  uint64
+	tick  uint64
+	index int
+}
+
+// lfuHeap orders entries by frequency, ties are broken by the least recent access.
+type lfuHeap[K comparable] []*lfuEntry[K]
+
+func (h lfuHeap[K]) Len() int { return len(h) }
+
+func (h lfuHeap[K]) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap[K]) Push(x any) {
+	e := x.(*lfuEntry[K])
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap[K]) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// lfuPolicy evicts the least frequently used key. Frequencies are halved every
+// agingPeriod accesses, so keys that were hot once but are not accessed anymore
+// do not stay in the cache forever.
+type lfuPolicy[K comparable] struct {
+	heap        lfuHeap[K]
+	entries     map[K]*lfuEntry[K]
+	tick        uint64
+	accesses    uint64
+	agingPeriod uint64
+}
+
+func newLFUPolicy[K comparable](capacity int) *lfuPolicy[K] {
+	return &lfuPolicy[K]{
+		entries:     make(map[K]*lfuEntry[K]),
+		agingPeriod: uint64(max(capacity, 1)) * lfuAgingFactor,
+	}
+}
+
+func (p *lfuPolicy[K]) Add(key K) {
+	if _, ok := p.entries[key]; ok {
+		p.Access(key)
+		return
+	}
+
+	p.tick++
+	e := &lfuEntry[K]{key: key, freq: 1, tick: p.tick}
+	p.entries[key] = e
+	heap.Push(&p.heap, e)
+	p.age()
+}
+
+func (p *lfuPolicy[K]) Access(key K) {
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+
+	p.tick++
+	e.freq++
+	e.tick = p.tick
+	heap.Fix(&p.heap, e.index)
+	p.age()
+}
+
+// age halves all frequencies once agingPeriod accesses passed since the last aging.
+func (p *lfuPolicy[K]) age() {
+	p.accesses++
+	if p.accesses < p.agingPeriod {
+		return
+	}
+
+	p.accesses = 0
+	for _, e := range p.heap {
+		e.freq /= 2
+	}
+	// Halving can make frequencies equal, which are ordered by tick instead.
+	heap.Init(&p.heap)
+}
+
+func (p *lfuPolicy[K]) Evict(key K) {
+	p.Remove(key)
+}
+
+func (p *lfuPolicy[K]) Remove(key K) {
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&p.heap, e.index)
+	delete(p.entries, key)
+}
+
+func (p *lfuPolicy[K]) Victim() (K, bool) {
+	if len(p.heap) == 0 {
+		var zero K
+		return zero, false
+	}
+	return p.heap[0].key, true
+}
+
+const (
+	queueIn = iota
+	queueOut
+	queueMain
+)
+
+type twoQueueEntry[K comparable] struct {
+	element *list.Element[K]
+	queue   int
+}
+
+// twoQueuePolicy is the full 2Q algorithm. New keys go to the in FIFO, keys evicted
+// from it are remembered in the out ghost FIFO, and keys added again while still
+// remembered are promoted to the main LRU. Keys seen only once, like a scan, never
+// push hot keys out of the main queue. Deleted and expired keys are not remembered,
+// their next add is not a sign of reuse.
+type twoQueuePolicy[K comparable] struct {
+	in      *list.List[K]
+	out     *list.List[K]
+	main    *list.List[K]
+	entries map[K]twoQueueEntry[K]
+	maxIn   int
+	maxOut  int
+}
+
+func newTwoQueuePolicy[K comparable](capacity int) *twoQueuePolicy[K] {
+	return &twoQueuePolicy[K]{
+		in:      list.NewList[K](),
+		out:     list.NewList[K](),
+		main:    list.NewList[K](),
+		entries: make(map[K]twoQueueEntry[K]),
+		maxIn:   max(capacity/4, 1),
+		maxOut:  max(capacity/2, 1),
+	}
+}
+
+func (p *twoQueuePolicy[K]) Add(key K) {
+	entry, ok := p.entries[key]
+	if ok && entry.queue != queueOut {
+		p.Access(key)
+		return
+	}
+
+	if ok {
+		p.out.Remove(entry.element)
+		p.entries[key] = twoQueueEntry[K]{element: p.main.Put(entry.element), queue: queueMain}
+		return
+	}
+
+	p.entries[key] = twoQueueEntry[K]{element: p.in.Put(&list.Element[K]{Value: key}), queue: queueIn}
+}
+
+func (p *twoQueuePolicy[K]) Access(key K) {
+	entry, ok := p.entries[key]
+	if ok && entry.queue == queueMain {
+		p.main.MoveToBack(entry.element)
+	}
+}
+
+func (p *twoQueuePolicy[K]) Evict(key K) {
+	entry, ok := p.entries[key]
+	if !ok || entry.queue != queueIn {
+		p.Remove(key)
+		return
+	}
+
+	p.in.Remove(entry.element)
+	p.entries[key] = twoQueueEntry[K]{element: p.out.Put(entry.element), queue: queueOut}
+	if p.out.Len() > p.maxOut {
+		front := p.out.Front()
+		p.out.Remove(front)
+		delete(p.entries, front.Value)
+	}
+}
+
+func (p *twoQueuePolicy[K]) Remove(key K) {
+	entry, ok := p.entries[key]
+	if !ok {
+		return
+	}
+
+	switch entry.queue {
+	case queueIn:
+		p.in.Remove(entry.element)
+	case queueOut:
+		p.out.Remove(entry.element)
+	case queueMain:
+		p.main.Remove(entry.element)
+	}
+	delete(p.entries, key)
+}
+
+func (p *twoQueuePolicy[K]) Victim() (K, bool) {
+	if p.in.Len() > p.maxIn || p.main.Len() == 0 {
+		if e := p.in.Front(); e != nil {
+			return e.Value, true
+		}
+	}
+
+	if e := p.main.Front(); e != nil {
+		return e.Value, true
+	}
+
+	var zero K
+	return zero, false
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTwoQueueRemembersOnlyEvictedKeys(t *testing.T) {
+	p := newTwoQueuePolicy[int](8)
+
+	p.Add(1)
+	p.Add(2)
+	p.Evict(1)
+	p.Remove(2)
+
+	if entry, ok := p.entries[1]; !ok || entry.queue != queueOut {
+		t.Errorf("evicted key is not remembered in the out queue")
+	}
+	if _, ok := p.entries[2]; ok || p.out.Len() != 1 {
+		t.Errorf("removed key is remembered")
+	}
+
+	// Only an evicted key added again is promoted to the main queue.
+	p.Add(1)
+	p.Add(2)
+	if entry := p.entries[1]; entry.queue != queueMain {
+		t.Errorf("evicted key added again went to queue %d, want main", entry.queue)
+	}
+	if entry := p.entries[2]; entry.queue != queueIn {
+		t.Errorf("removed key added again went to queue %d, want in", entry.queue)
+	}
+
+	// Removing a key remembered in the out queue forgets it.
+	p.Add(3)
+	p.Evict(3)
+	p.Remove(3)
+	if _, ok := p.entries[3]; ok || p.out.Len() != 0 {
+		t.Errorf("removed ghost key is remembered")
+	}
+}
+
+func TestTwoQueueCacheDeleteAndExpiry(t *testing.T) {
+	c := newTestCache[Int, ByteSlc](t, map[string]any{
+		"cache.eviction-policy": Policy2Q,
+		"cache.buckets-amount":  1,
+	})
+	p := c.buckets[0].policy.(*twoQueuePolicy[Int])
+
+	c.PutKey(1, ByteSlc("1"))
+	c.Delete(1)
+	c.PutKeyWithTTL(2, ByteSlc("2"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	c.Get(2)
+
+	if p.out.Len() != 0 {
+		t.Errorf("deleted or expired keys are remembered as evicted")
+	}
+
+	c.PutKey(1, ByteSlc("1"))
+	if entry := p.entries[1]; entry.queue != queueIn {
+		t.Errorf("key put again after delete went to queue %d, want in", entry.queue)
+	}
+}
+
+func TestLFUAging(t *testing.T) {
+	const capacity = 4
+	p := newLFUPolicy[int](capacity)
+
+	// Key 1 was hot before the frequencies were halved, key 2 is accessed less in total
+	// but mostly after that.
+	p.Add(1)
+	for i := 0; i < 30; i++ {
+		p.Access(1)
+	}
+	p.Add(2)
+	for i := 0; i < 20; i++ {
+		p.Access(2)
+	}
+
+	p.Add(3)
+	if victim, _ := p.Victim(); victim != 3 {
+		t.Fatalf("victim is %d, want the new key", victim)
+	}
+	p.Remove(3)
+
+	if victim, _ := p.Victim(); victim != 1 {
+		t.Errorf("victim is %d, want the key that is no longer accessed", victim)
+	}
+	for i, e := range p.heap {
+		if e.index != i {
+			t.Fatalf("heap entry %d has index %d", i, e.index)
+		}
+	}
+}
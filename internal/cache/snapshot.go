@@ -0,0 +1,320 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Snapshot layout, all integers are big endian:
+//
+//	header:  magic "WWNC" | version u8 | key type u8 | value type u8
+//	record:    recordMarker u8 | key length u32 | value length u32 | key | value | crc32c u32
+//	tombstone: tombstoneMarker u8 | key length u32 | key | crc32c u32
+//	trailer:   trailerMarker u8 | record count u64 | crc32c u32
+//
+// Record and tombstone checksums cover the lengths and the payload, the trailer
+// checksum covers the record count, which includes tombstones. Tombstones mark
+// deleted keys in delta snapshots and were added in version 2.
+const (
+	snapshotVersion    = 2
+	minSnapshotVersion = 1
+
+	recordMarker    = 0x01
+	tombstoneMarker = 0x02
+	trailerMarker   = 0xFF
+
+	maxChunkSize = 64 << 20
+)
+
+var snapshotMagic = [4]byte{'W', 'W', 'N', 'C'}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	typeUnknown uint8 = iota
+	typeInt
+	typeUint32
+	typeUint64
+	typeByteSlc
+	typeString
+)
+
+var (
+	ErrInvalidSnapshot     = errors.New("data is not a cache snapshot")
+	ErrUnsupportedVersion  = errors.New("unsupported cache snapshot version")
+	ErrTypeMismatch        = errors.New("cache snapshot key or value type mismatch")
+	ErrChecksumMismatch    = errors.New("cache snapshot checksum mismatch")
+	ErrRecordCountMismatch = errors.New("cache snapshot record count mismatch")
+	ErrChunkTooLarge       = errors.New("cache snapshot chunk is too large")
+)
+
+type Data[K Key[K], V Codec[V]] struct {
+	Key   K
+	Value V
+	// Deleted marks a tombstone, Value is empty.
+	Deleted bool
+}
+
+// typeOf returns the identifier written to the snapshot header for built-in types.
+// Custom types are written as typeUnknown and are not checked on decoding.
+func typeOf[T any]() uint8 {
+	var tmp T
+	switch any(tmp).(type) {
+	case Int:
+		return typeInt
+	case Uint32:
+		return typeUint32
+	case Uint64:
+		return typeUint64
+	case ByteSlc:
+		return typeByteSlc
+	case String:
+		return typeString
+	default:
+		return typeUnknown
+	}
+}
+
+type Encoder[K Key[K], V Codec[V]] struct {
+	writer io.Writer
+	count  uint64
+	buf    []byte
+}
+
+// NewEncoder writes the snapshot header to writer and returns an Encoder for the records.
+// Close must be called after the last record to write the trailer.
+func NewEncoder[K Key[K], V Codec[V]](writer io.Writer) (*Encoder[K, V], error) {
+	header := make([]byte, 0, len(snapshotMagic)+3)
+	header = append(header, snapshotMagic[:]...)
+	header = append(header, snapshotVersion, typeOf[K](), typeOf[V]())
+
+	_, err := writer.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encoder[K, V]{writer: writer}, nil
+}
+
+func (enc *Encoder[K, V]) Encode(item Data[K, V]) error {
+	rawByteKey, err := item.Key.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if item.Deleted {
+		return enc.encodeTombstone(rawByteKey)
+	}
+
+	rawByteValue, err := item.Value.Marshal()
+	if err != nil {
+		return err
+	}
+
+	enc.buf = append(enc.buf[:0], recordMarker)
+	enc.buf = binary.BigEndian.AppendUint32(enc.buf, uint32(len(rawByteKey)))
+	enc.buf = binary.BigEndian.AppendUint32(enc.buf, uint32(len(rawByteValue)))
+	enc.buf = append(enc.buf, rawByteKey...)
+	enc.buf = append(enc.buf, rawByteValue...)
+	enc.buf = binary.BigEndian.AppendUint32(enc.buf, crc32.Checksum(enc.buf[1:], crcTable))
+
+	_, err = enc.writer.Write(enc.buf)
+	if err != nil {
+		return err
+	}
+
+	enc.count++
+	return nil
+}
+
+func (enc *Encoder[K, V]) encodeTombstone(rawByteKey []byte) error {
+	enc.buf = append(enc.buf[:0], tombstoneMarker)
+	enc.buf = binary.BigEndian.AppendUint32(enc.buf, uint32(len(rawByteKey)))
+	enc.buf = append(enc.buf, rawByteKey...)
+	enc.buf = binary.BigEndian.AppendUint32(enc.buf, crc32.Checksum(enc.buf[1:], crcTable))
+
+	_, err := enc.writer.Write(enc.buf)
+	if err != nil {
+		return err
+	}
+
+	enc.count++
+	return nil
+}
+
+func (enc *Encoder[K, V]) Count() int {
+	return int(enc.count)
+}
+
+// Close writes the trailer. It does not close the underlying writer.
+func (enc *Encoder[K, V]) Close() error {
+	enc.buf = append(enc.buf[:0], trailerMarker)
+	enc.buf = binary.BigEndian.AppendUint64(enc.buf, enc.count)
+	enc.buf = binary.BigEndian.AppendUint32(enc.buf, crc32.Checksum(enc.buf[1:], crcTable))
+
+	_, err := enc.writer.Write(enc.buf)
+	return err
+}
+
+type Decoder[K Key[K], V Codec[V]] struct {
+	reader io.Reader
+	count  uint64
+	done   bool
+}
+
+// NewDecoder reads and validates the snapshot header from reader.
+func NewDecoder[K Key[K], V Codec[V]](reader io.Reader) (*Decoder[K, V], error) {
+	var header [len(snapshotMagic) + 3]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrInvalidSnapshot
+		}
+		return nil, err
+	}
+
+	if [4]byte(header[:4]) != snapshotMagic {
+		return nil, ErrInvalidSnapshot
+	}
+
+	if header[4] < minSnapshotVersion || header[4] > snapshotVersion {
+		return nil, ErrUnsupportedVersion
+	}
+
+	if !sameType(header[5], typeOf[K]()) || !sameType(header[6], typeOf[V]()) {
+		return nil, ErrTypeMismatch
+	}
+
+	return &Decoder[K, V]{reader: reader}, nil
+}
+
+func sameType(written, expected uint8) bool {
+	return written == typeUnknown || expected == typeUnknown || written == expected
+}
+
+// Decode returns the next record. It returns io.EOF after the trailer is read
+// and validated, and io.ErrUnexpectedEOF if the snapshot ends without a trailer.
+func (dec *Decoder[K, V]) Decode() (Data[K, V], error) {
+	var data Data[K, V]
+
+	if dec.done {
+		return data, io.EOF
+	}
+
+	var marker [1]byte
+	err := dec.readFull(marker[:])
+	if err != nil {
+		return data, err
+	}
+
+	switch marker[0] {
+	case recordMarker:
+	case tombstoneMarker:
+		return dec.decodeTombstone()
+	case trailerMarker:
+		return data, dec.readTrailer()
+	default:
+		return data, ErrInvalidSnapshot
+	}
+
+	var lengths [8]byte
+	err = dec.readFull(lengths[:])
+	if err != nil {
+		return data, err
+	}
+
+	keyLength := binary.BigEndian.Uint32(lengths[:4])
+	valueLength := binary.BigEndian.Uint32(lengths[4:])
+	if keyLength > maxChunkSize || valueLength > maxChunkSize {
+		return data, ErrChunkTooLarge
+	}
+
+	body := make([]byte, keyLength+valueLength+4)
+	err = dec.readFull(body)
+	if err != nil {
+		return data, err
+	}
+
+	checksum := crc32.Update(crc32.Checksum(lengths[:], crcTable), crcTable, body[:len(body)-4])
+	if checksum != binary.BigEndian.Uint32(body[len(body)-4:]) {
+		return data, ErrChecksumMismatch
+	}
+
+	data.Key, err = data.Key.Unmarshal(body[:keyLength])
+	if err != nil {
+		return data, err
+	}
+
+	data.Value, err = data.Value.Unmarshal(body[keyLength : keyLength+valueLength])
+	if err != nil {
+		return data, err
+	}
+
+	dec.count++
+	return data, nil
+}
+
+func (dec *Decoder[K, V]) decodeTombstone() (Data[K, V], error) {
+	var data Data[K, V]
+
+	var length [4]byte
+	err := dec.readFull(length[:])
+	if err != nil {
+		return data, err
+	}
+
+	keyLength := binary.BigEndian.Uint32(length[:])
+	if keyLength > maxChunkSize {
+		return data, ErrChunkTooLarge
+	}
+
+	body := make([]byte, keyLength+4)
+	err = dec.readFull(body)
+	if err != nil {
+		return data, err
+	}
+
+	checksum := crc32.Update(crc32.Checksum(length[:], crcTable), crcTable, body[:keyLength])
+	if checksum != binary.BigEndian.Uint32(body[keyLength:]) {
+		return data, ErrChecksumMismatch
+	}
+
+	data.Key, err = data.Key.Unmarshal(body[:keyLength])
+	if err != nil {
+		return data, err
+	}
+
+	data.Deleted = true
+	dec.count++
+	return data, nil
+}
+
+func (dec *Decoder[K, V]) readTrailer() error {
+	var trailer [12]byte
+	err := dec.readFull(trailer[:])
+	if err != nil {
+		return err
+	}
+
+	if crc32.Checksum(trailer[:8], crcTable) != binary.BigEndian.Uint32(trailer[8:]) {
+		return ErrChecksumMismatch
+	}
+
+	if binary.BigEndian.Uint64(trailer[:8]) != dec.count {
+		return ErrRecordCountMismatch
+	}
+
+	dec.done = true
+	return io.EOF
+}
+
+// readFull reports a missing trailer as io.ErrUnexpectedEOF.
+func (dec *Decoder[K, V]) readFull(buf []byte) error {
+	_, err := io.ReadFull(dec.reader, buf)
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
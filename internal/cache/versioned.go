@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"time"
+)
+
+// minPruneAt is the least number of tombstones of a bucket that triggers pruning.
+const minPruneAt = 64
+
+// tombstone remembers the version of a deleted key and when it was deleted.
+type tombstone struct {
+	version   uint64
+	deletedAt int64
+}
+
+// PutIfNewer stores value with the default ttl unless the key holds a value of the same or
+// a newer version, and reports whether it was stored. Values stored by PutKey, loaded by
+// GetOrLoad or restored from a snapshot have version zero. Delete keeps the version of
+// the deleted value for cache.delete-tombstone-ttl, so a stale write landing right after
+// a delete is rejected as well.
+func (c *Cache[K, V]) PutIfNewer(key K, value V, version uint64) bool {
+	item := c.newItem(value, expireAtFor(c.ttl))
+	item.version = version
+
+	b := c.bucketFor(key)
+	return b.putIf(key, item, func(current uint64, ok bool) bool {
+		if !ok {
+			var t tombstone
+			t, ok = b.tombstone(key)
+			current = t.version
+		}
+		return !ok || current < version
+	})
+}
+
+// CompareAndSwap stores value with newVersion if the key holds a value of version old,
+// a missing key counts as version zero. It reports whether value was stored.
+func (c *Cache[K, V]) CompareAndSwap(key K, old uint64, value V, newVersion uint64) bool {
+	item := c.newItem(value, expireAtFor(c.ttl))
+	item.version = newVersion
+
+	return c.bucketFor(key).putIf(key, item, func(current uint64, ok bool) bool {
+		return current == old
+	})
+}
+
+// GetVersioned is Get that also returns the version of the value.
+func (c *Cache[K, V]) GetVersioned(key K) (V, uint64, bool) {
+	b := c.bucketFor(key)
+
+	item, ok := b.get(key)
+	if ok && !item.negative {
+		var value V
+		value, ok = b.valueOrMiss(item)
+		if ok {
+			b.metrics.hits.Inc()
+			return value, item.version, true
+		}
+	}
+
+	b.metrics.misses.Inc()
+	var zero V
+	return zero, 0, false
+}
+
+// putIf stores item if accept returns true for the version of the current value. Negative
+// and expired entries are passed as missing with version zero.
+func (c *bucket[K, V]) putIf(key K, item Item[K, V], accept func(current uint64, ok bool) bool) bool {
+	c.lock()
+	defer c.unlock()
+
+	old, ok := c.items[key]
+	if ok && (old.negative || old.expired(time.Now().UnixNano())) {
+		old, ok = Item[K, V]{}, false
+	}
+
+	if !accept(old.version, ok) {
+		return false
+	}
+
+	c.storeItem(key, item)
+	return true
+}
+
+// addTombstone remembers key as deleted, it must be called with c.mx held. Expired
+// tombstones are pruned once their number doubles since the last pruning.
+func (c *bucket[K, V]) addTombstone(key K, version uint64) {
+	if c.tombstoneTTL <= 0 {
+		return
+	}
+	if c.tombstones == nil {
+		c.tombstones = make(map[K]tombstone)
+		c.pruneAt = minPruneAt
+	}
+
+	now := time.Now().UnixNano()
+	if t, ok := c.tombstones[key]; ok {
+		version = max(version, t.version)
+	}
+	c.tombstones[key] = tombstone{version: version, deletedAt: now}
+
+	if len(c.tombstones) < c.pruneAt {
+		return
+	}
+	for k, t := range c.tombstones {
+		if now-t.deletedAt > int64(c.tombstoneTTL) {
+			delete(c.tombstones, k)
+		}
+	}
+	c.pruneAt = max(minPruneAt, 2*len(c.tombstones))
+}
+
+// tombstone returns the tombstone of key if it was deleted less than tombstoneTTL ago,
+// it must be called with c.mx held.
+func (c *bucket[K, V]) tombstone(key K) (tombstone, bool) {
+	t, ok := c.tombstones[key]
+	if !ok || time.Now().UnixNano()-t.deletedAt > int64(c.tombstoneTTL) {
+		return tombstone{}, false
+	}
+	return t, true
+}
+
+// deletedSince reports whether key was deleted at or after start, it must be called with c.mx held.
+func (c *bucket[K, V]) deletedSince(key K, start int64) bool {
+	t, ok := c.tombstone(key)
+	return ok && t.deletedAt >= start
+}
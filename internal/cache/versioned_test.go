@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPutIfNewerRacingWriters(t *testing.T) {
+	const (
+		writers  = 16
+		versions = 1000
+	)
+
+	c := newTestCache[Int, ByteSlc](t, nil)
+
+	order := rand.Perm(versions)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < versions; i += writers {
+				version := uint64(order[i] + 1)
+				c.PutIfNewer(1, ByteSlc(strconv.FormatUint(version, 10)), version)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	value, version, ok := c.GetVersioned(1)
+	if !ok || version != versions || string(value) != strconv.Itoa(versions) {
+		t.Errorf("got %q of version %d, %v, want version %d", value, version, ok, versions)
+	}
+
+	if c.PutIfNewer(1, ByteSlc("stale"), versions) {
+		t.Errorf("put of the current version was accepted")
+	}
+}
+
+func TestCompareAndSwapRacingSwappers(t *testing.T) {
+	const swappers = 32
+
+	c := newTestCache[Int, ByteSlc](t, nil)
+	c.PutIfNewer(1, ByteSlc("initial"), 1)
+
+	var swapped atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for s := 0; s < swappers; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			<-start
+			if c.CompareAndSwap(1, 1, ByteSlc(strconv.Itoa(s)), 2) {
+				swapped.Add(1)
+			}
+		}(s)
+	}
+	close(start)
+	wg.Wait()
+
+	if swapped.Load() != 1 {
+		t.Errorf("%d swappers succeeded, want 1", swapped.Load())
+	}
+
+	_, version, _ := c.GetVersioned(1)
+	if version != 2 {
+		t.Errorf("got version %d, want 2", version)
+	}
+}
+
+func TestStaleWriteAfterDelete(t *testing.T) {
+	c := newTestCache[Int, ByteSlc](t, map[string]any{"cache.delete-tombstone-ttl": time.Minute})
+
+	c.PutIfNewer(1, ByteSlc("v5"), 5)
+	c.Delete(1)
+
+	if c.PutIfNewer(1, ByteSlc("v3"), 3) {
+		t.Errorf("write older than the deleted version was accepted")
+	}
+	if !c.PutIfNewer(1, ByteSlc("v6"), 6) {
+		t.Errorf("write newer than the deleted version was rejected")
+	}
+}
+
+func TestLoadRacingDelete(t *testing.T) {
+	c := newTestCache[Int, ByteSlc](t, map[string]any{
+		"cache.delete-tombstone-ttl": time.Minute,
+		"cache.negative-ttl":         time.Minute,
+	})
+
+	// The invalidation lands while the loader holds data read before the change.
+	for _, loadErr := range []error{nil, ErrNotFound} {
+		loading, deleted := make(chan struct{}), make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, _ = c.GetOrLoad(1, func(Int) (ByteSlc, error) {
+				close(loading)
+				<-deleted
+				return ByteSlc("stale"), loadErr
+			})
+		}()
+
+		<-loading
+		c.Delete(1)
+		close(deleted)
+		<-done
+
+		if _, ok := c.Get(1); ok {
+			t.Errorf("value loaded before a delete was cached")
+		}
+
+		value, err := c.GetOrLoad(1, func(Int) (ByteSlc, error) {
+			return ByteSlc("fresh"), nil
+		})
+		if err != nil || string(value) != "fresh" {
+			t.Fatalf("load after the delete returned %q, %v", value, err)
+		}
+		if value, ok := c.Get(1); !ok || string(value) != "fresh" {
+			t.Errorf("value loaded after a delete was not cached")
+		}
+		c.Delete(1)
+	}
+
+	_, err := c.GetOrLoad(2, func(Int) (ByteSlc, error) { return nil, ErrNotFound })
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("load of a missing key returned %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestPutManyRacingWrites(t *testing.T) {
+	c := newTestCache[Int, ByteSlc](t, map[string]any{"cache.delete-tombstone-ttl": time.Minute})
+
+	c.PutIfNewer(3, ByteSlc("before-read"), 1)
+	c.Delete(3)
+
+	// Keys 1 and 2 change while the batch is read from the source.
+	readAt := time.Now()
+	c.PutIfNewer(1, ByteSlc("newer"), 7)
+	c.PutKey(2, ByteSlc("deleted"))
+	c.Delete(2)
+
+	c.PutMany([]Data[Int, ByteSlc]{
+		{Key: 1, Value: ByteSlc("stale")},
+		{Key: 2, Value: ByteSlc("stale")},
+		{Key: 3, Value: ByteSlc("read")},
+		{Key: 4, Value: ByteSlc("read")},
+	}, readAt)
+
+	if value, version, _ := c.GetVersioned(1); string(value) != "newer" || version != 7 {
+		t.Errorf("batch read before a put replaced it with %q of version %d", value, version)
+	}
+	if value, ok := c.Get(2); ok {
+		t.Errorf("batch read before a delete stored %q", value)
+	}
+	for _, key := range []Int{3, 4} {
+		if value, ok := c.Get(key); !ok || string(value) != "read" {
+			t.Errorf("got %q, %v for %d, want the batch value", value, ok, key)
+		}
+	}
+
+	// Restored records are older than any delete.
+	c.Delete(4)
+	c.Apply([]Data[Int, ByteSlc]{{Key: 4, Value: ByteSlc("restored")}, {Key: 5, Value: ByteSlc("restored")}})
+	if _, ok := c.Get(4); ok {
+		t.Errorf("restored record of a deleted key was stored")
+	}
+	if _, ok := c.Get(5); !ok {
+		t.Errorf("restored record was not stored")
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"bufio"
 	"encoding/json"
 	"errors"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/backup"
 	"github.com/PrettyPepeBoy/WorkWithNats/internal/cache"
 	"github.com/PrettyPepeBoy/WorkWithNats/internal/objects/product"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/sharding"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/warmup"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
@@ -52,20 +55,24 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 }
 
 type HttpHandler struct {
-	productCache *cache.Cache[cache.Int, cache.ByteSlc]
-	productTable *product.Table
-	promHandler  fasthttp.RequestHandler
+	productCache  *cache.Cache[cache.Int, cache.ByteSlc]
+	productGroup  *sharding.Group[cache.Int, cache.ByteSlc]
+	productTable  *product.Table
+	productBackup *backup.Manager[cache.Int, cache.ByteSlc]
+	productWarmer *warmup.Warmer[cache.Int, cache.ByteSlc]
+	promHandler   fasthttp.RequestHandler
 
 	metrics *metrics
 }
 
-func NewHttpHandler(productCache *cache.Cache[cache.Int, cache.ByteSlc], productTable *product.Table) *HttpHandler {
-	reg := prometheus.NewRegistry()
-
+func NewHttpHandler(productCache *cache.Cache[cache.Int, cache.ByteSlc], productGroup *sharding.Group[cache.Int, cache.ByteSlc], productTable *product.Table, productBackup *backup.Manager[cache.Int, cache.ByteSlc], productWarmer *warmup.Warmer[cache.Int, cache.ByteSlc], reg *prometheus.Registry) *HttpHandler {
 	return &HttpHandler{
-		productCache: productCache,
-		productTable: productTable,
-		promHandler:  fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(reg, promhttp.HandlerOpts{})),
+		productCache:  productCache,
+		productGroup:  productGroup,
+		productTable:  productTable,
+		productBackup: productBackup,
+		productWarmer: productWarmer,
+		promHandler:   fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(reg, promhttp.HandlerOpts{})),
 
 		metrics: newMetrics(reg),
 	}
@@ -118,6 +125,15 @@ func (h *HttpHandler) Handle(ctx *fasthttp.RequestCtx) {
 			ctx.SetStatusCode(fasthttp.StatusNotFound)
 		}
 
+	case "/api/v1/cache/backup":
+		h.metrics.counter.Inc()
+		switch string(ctx.Method()) {
+		case fasthttp.MethodPost:
+			h.backupCache(ctx)
+		default:
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+		}
+
 	case "/api/v1/metrics":
 		h.promHandler(ctx)
 
@@ -139,32 +155,9 @@ func (h *HttpHandler) getProduct(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	cacheData, find := h.productCache.Get(cache.Int(id))
-	if find {
-		rawByte, err := cacheData.Marshal()
-		if err != nil {
-			logrus.Info("failed to cast data")
-			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-			h.metrics.durationReply("getProduct", fasthttp.MethodGet, strconv.Itoa(fasthttp.StatusInternalServerError), t)
-			return
-		}
-
-		err = json.Unmarshal(rawByte, &p.Product[0])
-		if err != nil {
-			logrus.Error("failed to unmarshal json", err)
-			h.metrics.durationReply("getProduct", fasthttp.MethodGet, strconv.Itoa(fasthttp.StatusInternalServerError), t)
-			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-			return
-		}
-
-		ProductsHTMLResponse(ctx, p)
-		h.metrics.durationReply("getProduct", fasthttp.MethodGet, strconv.Itoa(fasthttp.StatusOK), t)
-		return
-	}
-
-	databaseData, err := h.productTable.GetById(id)
+	data, err := h.productGroup.Get(cache.Int(id))
 	if err != nil {
-		if errors.Is(err, product.ErrRowNotExist) {
+		if errors.Is(err, cache.ErrNotFound) {
 			ctx.SetStatusCode(fasthttp.StatusNoContent)
 			h.metrics.durationReply("getProduct", fasthttp.MethodGet, strconv.Itoa(fasthttp.StatusNoContent), t)
 		} else {
@@ -175,7 +168,9 @@ func (h *HttpHandler) getProduct(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	err = json.Unmarshal(databaseData, &p.Product[0])
+	h.productWarmer.Record(cache.Int(id))
+
+	err = json.Unmarshal(data, &p.Product[0])
 	if err != nil {
 		logrus.Error("failed to unmarshal json", err)
 		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
@@ -185,26 +180,59 @@ func (h *HttpHandler) getProduct(ctx *fasthttp.RequestCtx) {
 
 	ProductsHTMLResponse(ctx, p)
 	h.metrics.durationReply("getProduct", fasthttp.MethodGet, strconv.Itoa(fasthttp.StatusOK), t)
-	h.productCache.PutKey(cache.Int(id), databaseData)
 }
 
 func (h *HttpHandler) getAllProducts(ctx *fasthttp.RequestCtx) {
-	var Products product.Products
-	var Product product.Product
-	var id uint32
-	rows, err := h.productTable.GetAllFromTable()
+	ids, err := h.productTable.GetAllIds()
 	if err != nil {
 		logrus.Error("failed to get all products from table")
 		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 		return
 	}
 
-	for rows.Next() {
-		err = rows.Scan(&id, &Product)
+	keys := make([]cache.Int, len(ids))
+	for i, id := range ids {
+		keys[i] = cache.Int(id)
+	}
+
+	found, missing := h.productCache.GetMany(keys)
+	if len(missing) > 0 {
+		missingIds := make([]int, len(missing))
+		for i, key := range missing {
+			missingIds[i] = int(key)
+		}
+
+		readAt := time.Now()
+		rows, err := h.productTable.GetByIds(missingIds)
 		if err != nil {
+			logrus.Errorf("failed to get products from table, error: %v", err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 			return
 		}
-		Product.Id = id
+
+		loaded := make([]cache.Data[cache.Int, cache.ByteSlc], len(rows))
+		for i, row := range rows {
+			loaded[i] = cache.Data[cache.Int, cache.ByteSlc]{Key: cache.Int(row.Id), Value: row.Data}
+			found[cache.Int(row.Id)] = row.Data
+		}
+		h.productCache.PutMany(loaded, readAt)
+	}
+
+	var Products product.Products
+	Products.Product = make([]product.Product, 0, len(found))
+	for _, key := range keys {
+		data, ok := found[key]
+		if !ok {
+			continue
+		}
+
+		var Product product.Product
+		err = json.Unmarshal(data, &Product)
+		if err != nil {
+			logrus.Errorf("failed to unmarshal json, error: %v", err)
+			continue
+		}
+		Product.Id = uint32(key)
 		Products.Product = append(Products.Product, Product)
 	}
 
@@ -224,6 +252,22 @@ func (h *HttpHandler) dumpCache(ctx *fasthttp.RequestCtx) {
 	ctx.SetStatusCode(fasthttp.StatusOK)
 }
 
+func (h *HttpHandler) backupCache(ctx *fasthttp.RequestCtx) {
+	t := time.Now()
+
+	res, err := h.productBackup.Snapshot()
+	if err != nil {
+		logrus.Errorf("failed to backup cache, error: %v", err)
+		WriteErrorResponse(ctx, fasthttp.StatusInternalServerError, err.Error())
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		h.metrics.durationReply("backupCache", fasthttp.MethodPost, strconv.Itoa(fasthttp.StatusInternalServerError), t)
+		return
+	}
+
+	WriteJson(ctx, res)
+	h.metrics.durationReply("backupCache", fasthttp.MethodPost, strconv.Itoa(fasthttp.StatusOK), t)
+}
+
 func (m *metrics) durationReply(endpoint string, method string, status string, t time.Time) {
 	m.duration.With(prometheus.Labels{"endpoint": endpoint, "method": method, "status": status}).Observe(time.Since(t).Seconds())
 }
@@ -0,0 +1,136 @@
+package invalidation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/cache"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"sync"
+)
+
+// Bus keeps caches of several service instances consistent: keys invalidated on one
+// instance are deleted locally and published, other instances delete them on receive.
+type Bus[K cache.Key[K], V cache.Codec[V]] struct {
+	natsConn *nats.Conn
+	natsSubs *nats.Subscription
+	subject  string
+	instance string
+	cache    *cache.Cache[K, V]
+
+	mx        sync.RWMutex
+	onReceive []func(key K)
+}
+
+type message struct {
+	Instance string   `json:"instance"`
+	Keys     [][]byte `json:"keys"`
+}
+
+func NewBus[K cache.Key[K], V cache.Codec[V]](natsConn *nats.Conn, c *cache.Cache[K, V], subject string) (*Bus[K, V], error) {
+	instance := viper.GetString("cache.invalidation.instance-id")
+	if instance == "" {
+		var err error
+		instance, err = newInstanceId()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b := &Bus[K, V]{
+		natsConn: natsConn,
+		subject:  subject,
+		instance: instance,
+		cache:    c,
+	}
+
+	var err error
+	b.natsSubs, err = natsConn.Subscribe(subject, b.Process)
+	if err != nil {
+		logrus.Errorf("[NewBus] failed to subscribe to %s, error: %v", subject, err)
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func newInstanceId() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Invalidate deletes keys from the local cache and tells other instances to delete them.
+func (b *Bus[K, V]) Invalidate(keys ...K) error {
+	msg := message{
+		Instance: b.instance,
+		Keys:     make([][]byte, 0, len(keys)),
+	}
+
+	for _, key := range keys {
+		b.cache.Delete(key)
+
+		rawByteKey, err := key.Marshal()
+		if err != nil {
+			return err
+		}
+		msg.Keys = append(msg.Keys, rawByteKey)
+	}
+
+	rawByte, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return b.natsConn.Publish(b.subject, rawByte)
+}
+
+// OnReceive registers fn to be called for every key invalidated by another instance,
+// before it is deleted from the local cache, so a load after the delete sees what fn did.
+func (b *Bus[K, V]) OnReceive(fn func(key K)) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.onReceive = append(b.onReceive, fn)
+}
+
+func (b *Bus[K, V]) Process(msg *nats.Msg) {
+	var m message
+
+	err := json.Unmarshal(msg.Data, &m)
+	if err != nil {
+		logrus.Warn("failed to unmarshal invalidation message, error: ", err)
+		return
+	}
+
+	if m.Instance == b.instance {
+		return
+	}
+
+	b.mx.RLock()
+	onReceive := b.onReceive
+	b.mx.RUnlock()
+
+	var zero K
+	for _, rawByteKey := range m.Keys {
+		key, err := zero.Unmarshal(rawByteKey)
+		if err != nil {
+			logrus.Warn("failed to unmarshal invalidated key, error: ", err)
+			continue
+		}
+		for _, fn := range onReceive {
+			fn(key)
+		}
+
+		b.cache.Delete(key)
+	}
+}
+
+func (b *Bus[K, V]) Close() error {
+	return b.natsSubs.Unsubscribe()
+}
@@ -9,14 +9,25 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"os"
+	"sync"
 )
 
+// Table serializes queries with mx since a pgx.Conn can not be used concurrently.
 type Table struct {
+	mx                  sync.Mutex
 	db                  *pgx.Conn
 	putInTableStmt      *pgconn.StatementDescription
 	getFromTableStmt    *pgconn.StatementDescription
 	deleteFromTableStmt *pgconn.StatementDescription
 	getAllFromTableStmt *pgconn.StatementDescription
+	getRecentIdsStmt    *pgconn.StatementDescription
+	getByIdsStmt        *pgconn.StatementDescription
+	getAllIdsStmt       *pgconn.StatementDescription
+}
+
+type Row struct {
+	Id   int
+	Data []byte
 }
 
 var (
@@ -39,7 +50,7 @@ func NewTable() (*Table, error) {
 		return nil, err
 	}
 
-	putInTableStmt, err := conn.Prepare(context.Background(), "Put", `INSERT INTO products(name, json_data) VALUES ($1, $2) RETURNING id`)
+	putInTableStmt, err := conn.Prepare(context.Background(), "Put", `INSERT INTO products(name, json_data) VALUES ($1, $2) RETURNING id, version`)
 	if err != nil {
 		logrus.Errorf("failed to prepare createTableStmt, error: %v", err)
 		return nil, err
@@ -63,23 +74,53 @@ func NewTable() (*Table, error) {
 		return nil, err
 	}
 
+	getRecentIdsStmt, err := conn.Prepare(context.Background(), "GetRecentIds", `SELECT id FROM products ORDER BY id DESC LIMIT $1`)
+	if err != nil {
+		logrus.Errorf("failed to prepare getRecentIdsStmt, error: %v", err)
+		return nil, err
+	}
+
+	getByIdsStmt, err := conn.Prepare(context.Background(), "GetByIds", `SELECT id, json_data FROM products WHERE id = ANY($1)`)
+	if err != nil {
+		logrus.Errorf("failed to prepare getByIdsStmt, error: %v", err)
+		return nil, err
+	}
+
+	getAllIdsStmt, err := conn.Prepare(context.Background(), "GetAllIds", `SELECT id FROM products ORDER BY id`)
+	if err != nil {
+		logrus.Errorf("failed to prepare getAllIdsStmt, error: %v", err)
+		return nil, err
+	}
+
 	return &Table{db: conn,
 		putInTableStmt:      putInTableStmt,
 		getFromTableStmt:    getFromTableStmt,
 		deleteFromTableStmt: deleteFromTableStmt,
 		getAllFromTableStmt: getAllFromTable,
+		getRecentIdsStmt:    getRecentIdsStmt,
+		getByIdsStmt:        getByIdsStmt,
+		getAllIdsStmt:       getAllIdsStmt,
 	}, nil
 }
 
-func (s *Table) Put(name string, data []byte) (int, error) {
+// Put returns the id of the inserted product and the version of the row. Versions are
+// taken from products_version_seq on insert and on every update, so they grow with every write.
+func (s *Table) Put(name string, data []byte) (int, int64, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
 	var id int
-	if err := s.db.QueryRow(context.Background(), s.putInTableStmt.Name, name, data).Scan(&id); err != nil {
-		return 0, err
+	var version int64
+	if err := s.db.QueryRow(context.Background(), s.putInTableStmt.Name, name, data).Scan(&id, &version); err != nil {
+		return 0, 0, err
 	}
-	return id, nil
+	return id, version, nil
 }
 
 func (s *Table) GetById(id int) ([]byte, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
 	var data []byte
 	if err := s.db.QueryRow(context.Background(), s.getFromTableStmt.Name, id).Scan(&data); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -91,6 +132,9 @@ func (s *Table) GetById(id int) ([]byte, error) {
 }
 
 func (s *Table) DeleteById(id int) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
 	var err error
 	err = s.db.QueryRow(context.Background(), s.deleteFromTableStmt.Name, id).Scan()
 	if errors.Is(err, pgx.ErrNoRows) {
@@ -110,3 +154,60 @@ func (s *Table) GetAllFromTable() (pgx.Rows, error) {
 
 	return rows, nil
 }
+
+// GetRecentIds returns ids of the last limit inserted products, newest first.
+func (s *Table) GetRecentIds(limit int) ([]int, error) {
+	return s.getIds(s.getRecentIdsStmt.Name, limit)
+}
+
+// GetAllIds returns ids of all products in ascending order.
+func (s *Table) GetAllIds() ([]int, error) {
+	return s.getIds(s.getAllIdsStmt.Name)
+}
+
+func (s *Table) getIds(stmt string, args ...any) ([]int, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	rows, err := s.db.Query(context.Background(), stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// GetByIds returns the existing products out of ids in no particular order.
+func (s *Table) GetByIds(ids []int) ([]Row, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	rows, err := s.db.Query(context.Background(), s.getByIdsStmt.Name, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]Row, 0, len(ids))
+	for rows.Next() {
+		var row Row
+		err = rows.Scan(&row.Id, &row.Data)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
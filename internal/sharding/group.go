@@ -0,0 +1,253 @@
+package sharding
+
+import (
+	"errors"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/cache"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	replyNotFound byte = iota
+	replyFound
+	replyError
+)
+
+var (
+	ErrPeerFailed = errors.New("peer failed to load key")
+)
+
+// Group partitions keys between service instances. Every key is owned by one peer of the
+// ring, only the owner caches it and loads it on a miss, other peers ask the owner over
+// NATS request-reply. If the owner does not answer the key is loaded and cached locally
+// through Cache.GetOrLoad, and an owner that failed cache.sharding.failures-before-skip
+// times in a row is not asked for cache.sharding.skip-duration.
+type Group[K cache.Key[K], V cache.Codec[V]] struct {
+	cache    *cache.Cache[K, V]
+	loader   func(K) (V, error)
+	natsConn *nats.Conn
+	natsSubs *nats.Subscription
+	ring     *ring
+	self     string
+	subject  string
+	timeout  time.Duration
+	// workers limits the number of peer requests served at once.
+	workers chan struct{}
+
+	mx                 sync.Mutex
+	health             map[string]*peerHealth
+	failuresBeforeSkip int
+	skipDuration       time.Duration
+}
+
+// peerHealth counts failed requests to a peer in a row, a failing peer is skipped until retryAt.
+type peerHealth struct {
+	failures int
+	retryAt  time.Time
+}
+
+// NewGroup reads the peer list from cache.sharding. Without cache.sharding.self the
+// instance owns every key and Get is the same as Cache.GetOrLoad. Peer requests are
+// served by up to cache.sharding.workers goroutines.
+func NewGroup[K cache.Key[K], V cache.Codec[V]](natsConn *nats.Conn, c *cache.Cache[K, V], subject string, loader func(K) (V, error)) (*Group[K, V], error) {
+	g := &Group[K, V]{
+		cache:    c,
+		loader:   loader,
+		natsConn: natsConn,
+		self:     viper.GetString("cache.sharding.self"),
+		subject:  subject,
+		timeout:  viper.GetDuration("cache.sharding.timeout"),
+		workers:  make(chan struct{}, max(viper.GetInt("cache.sharding.workers"), 1)),
+
+		health:             make(map[string]*peerHealth),
+		failuresBeforeSkip: max(viper.GetInt("cache.sharding.failures-before-skip"), 1),
+		skipDuration:       viper.GetDuration("cache.sharding.skip-duration"),
+	}
+
+	if g.self == "" {
+		return g, nil
+	}
+
+	peers := viper.GetStringSlice("cache.sharding.peers")
+	if !slices.Contains(peers, g.self) {
+		peers = append(peers, g.self)
+	}
+	g.ring = newRing(peers, viper.GetInt("cache.sharding.replicas"))
+
+	var err error
+	g.natsSubs, err = natsConn.Subscribe(g.peerSubject(g.self), g.Process)
+	if err != nil {
+		logrus.Errorf("[NewGroup] failed to subscribe to %s, error: %v", g.peerSubject(g.self), err)
+		return nil, err
+	}
+
+	return g, nil
+}
+
+func (g *Group[K, V]) peerSubject(peer string) string {
+	return g.subject + "." + peer
+}
+
+// Get returns the value of key from the owning peer, loading it on a miss.
+func (g *Group[K, V]) Get(key K) (V, error) {
+	owner, rawByteKey, err := g.owner(key)
+	if err != nil || owner == g.self || !g.available(owner) {
+		return g.cache.GetOrLoad(key, g.loader)
+	}
+
+	value, err := g.getFromPeer(owner, rawByteKey)
+	if err == nil || errors.Is(err, cache.ErrNotFound) || errors.Is(err, ErrPeerFailed) {
+		// A peer that answers is healthy, even if its loader failed.
+		g.succeeded(owner)
+	} else {
+		g.failed(owner)
+	}
+	if err == nil || errors.Is(err, cache.ErrNotFound) {
+		return value, err
+	}
+
+	logrus.Warnf("failed to get key from peer %s, falling back to loader, error: %v", owner, err)
+	return g.cache.GetOrLoad(key, g.loader)
+}
+
+// available reports whether peer should be asked. Once a skipped peer is due to be retried,
+// one request is let through and the others keep skipping it until that one fails or succeeds.
+func (g *Group[K, V]) available(peer string) bool {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	h, ok := g.health[peer]
+	if !ok || h.failures < g.failuresBeforeSkip {
+		return true
+	}
+
+	now := time.Now()
+	if now.Before(h.retryAt) {
+		return false
+	}
+	h.retryAt = now.Add(g.skipDuration)
+	return true
+}
+
+func (g *Group[K, V]) succeeded(peer string) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	delete(g.health, peer)
+}
+
+func (g *Group[K, V]) failed(peer string) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	h, ok := g.health[peer]
+	if !ok {
+		h = &peerHealth{}
+		g.health[peer] = h
+	}
+
+	h.failures++
+	if h.failures == g.failuresBeforeSkip {
+		logrus.Warnf("skipping cache peer %s for %v after %d failed requests", peer, g.skipDuration, h.failures)
+	}
+	if h.failures >= g.failuresBeforeSkip {
+		h.retryAt = time.Now().Add(g.skipDuration)
+	}
+}
+
+func (g *Group[K, V]) owner(key K) (string, []byte, error) {
+	if g.ring == nil {
+		return g.self, nil, nil
+	}
+
+	rawByteKey, err := key.Marshal()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return g.ring.owner(rawByteKey), rawByteKey, nil
+}
+
+func (g *Group[K, V]) getFromPeer(peer string, rawByteKey []byte) (V, error) {
+	var value V
+
+	msg, err := g.natsConn.Request(g.peerSubject(peer), rawByteKey, g.timeout)
+	if err != nil {
+		return value, err
+	}
+
+	if len(msg.Data) == 0 {
+		return value, ErrPeerFailed
+	}
+
+	switch msg.Data[0] {
+	case replyFound:
+		return value.Unmarshal(msg.Data[1:])
+	case replyNotFound:
+		return value, cache.ErrNotFound
+	default:
+		return value, ErrPeerFailed
+	}
+}
+
+// Process answers get requests of other peers for keys owned by this instance. NATS
+// delivers messages of a subscription one by one, so every request is served in its
+// own goroutine and a slow load does not hold up the requests queued behind it. When
+// all workers are busy Process blocks, leaving the requests pending in the subscription.
+func (g *Group[K, V]) Process(msg *nats.Msg) {
+	g.workers <- struct{}{}
+	go func() {
+		defer func() { <-g.workers }()
+		g.serve(msg)
+	}()
+}
+
+func (g *Group[K, V]) serve(msg *nats.Msg) {
+	var zero K
+
+	key, err := zero.Unmarshal(msg.Data)
+	if err != nil {
+		logrus.Warn("failed to unmarshal requested key, error: ", err)
+		g.respond(msg, []byte{replyError})
+		return
+	}
+
+	value, err := g.cache.GetOrLoad(key, g.loader)
+	if err != nil {
+		if errors.Is(err, cache.ErrNotFound) {
+			g.respond(msg, []byte{replyNotFound})
+			return
+		}
+
+		logrus.Errorf("failed to load requested key, error: %v", err)
+		g.respond(msg, []byte{replyError})
+		return
+	}
+
+	rawByteValue, err := value.Marshal()
+	if err != nil {
+		logrus.Errorf("failed to marshal requested value, error: %v", err)
+		g.respond(msg, []byte{replyError})
+		return
+	}
+
+	g.respond(msg, append([]byte{replyFound}, rawByteValue...))
+}
+
+func (g *Group[K, V]) respond(msg *nats.Msg, data []byte) {
+	err := msg.Respond(data)
+	if err != nil {
+		logrus.Errorf("failed to respond to peer, error: %v", err)
+	}
+}
+
+func (g *Group[K, V]) Close() error {
+	if g.natsSubs == nil {
+		return nil
+	}
+	return g.natsSubs.Unsubscribe()
+}
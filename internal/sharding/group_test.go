@@ -0,0 +1,43 @@
+package sharding
+
+import (
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/cache"
+	"testing"
+	"time"
+)
+
+func TestPeerSkipping(t *testing.T) {
+	g := &Group[cache.Int, cache.ByteSlc]{
+		health:             make(map[string]*peerHealth),
+		failuresBeforeSkip: 3,
+		skipDuration:       50 * time.Millisecond,
+	}
+
+	for i := 0; i < 2; i++ {
+		g.failed("a")
+	}
+	if !g.available("a") {
+		t.Fatalf("peer skipped before it failed enough times")
+	}
+
+	g.failed("a")
+	if g.available("a") || g.available("a") {
+		t.Fatalf("failing peer was not skipped")
+	}
+	if !g.available("b") {
+		t.Errorf("other peer was skipped")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !g.available("a") {
+		t.Fatalf("skipped peer was not retried")
+	}
+	if g.available("a") {
+		t.Errorf("more than one request retried the skipped peer")
+	}
+
+	g.succeeded("a")
+	if !g.available("a") {
+		t.Errorf("peer that answered is still skipped")
+	}
+}
@@ -0,0 +1,67 @@
+package sharding
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ring is a consistent hash ring. Unlike the bucket hashing in cache, which is seeded
+// per process, its hash must be the same on every instance, so fnv is used.
+type ring struct {
+	hashes []uint64
+	owners map[uint64]string
+}
+
+func newRing(peers []string, replicas int) *ring {
+	r := &ring{
+		hashes: make([]uint64, 0, len(peers)*replicas),
+		owners: make(map[uint64]string, len(peers)*replicas),
+	}
+
+	for _, peer := range peers {
+		for i := 0; i < replicas; i++ {
+			h := hashBytes([]byte(strconv.Itoa(i) + "-" + peer))
+			r.hashes = append(r.hashes, h)
+			r.owners[h] = peer
+		}
+	}
+
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+
+	return r
+}
+
+// owner returns the peer owning key, the first point of the ring clockwise from its hash.
+func (r *ring) owner(key []byte) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := hashBytes(key)
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+
+	return r.owners[r.hashes[i]]
+}
+
+// hashBytes mixes the fnv hash with the murmur3 finalizer, plain fnv of short
+// sequential keys like product ids differs only in low bits and clusters on the ring.
+func hashBytes(b []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
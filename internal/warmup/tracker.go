@@ -0,0 +1,199 @@
+package warmup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/cache"
+	"hash/maphash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// trackerShards is the number of independently locked parts of a tracker.
+const trackerShards = 16
+
+// tracker counts accesses per key to find the hot keys of a run. Keys are split between
+// shards, so concurrent records of different keys rarely wait for each other. A shard holds
+// up to its share of maxKeys keys, when it is full the keys with the least count are
+// forgotten, so keys accessed once, like a scan, make room for new keys while keys
+// accessed often keep being tracked.
+type tracker[K cache.Key[K]] struct {
+	shards []trackerShard[K]
+	seed   maphash.Seed
+}
+
+type trackerShard[K cache.Key[K]] struct {
+	mx      sync.Mutex
+	counts  map[K]uint64
+	maxKeys int
+}
+
+func newTracker[K cache.Key[K]](maxKeys int) *tracker[K] {
+	t := &tracker[K]{
+		shards: make([]trackerShard[K], trackerShards),
+		seed:   maphash.MakeSeed(),
+	}
+	for i := range t.shards {
+		t.shards[i].counts = make(map[K]uint64)
+		t.shards[i].maxKeys = max(maxKeys/trackerShards, 1)
+	}
+	return t
+}
+
+func (t *tracker[K]) record(key K) {
+	s := &t.shards[key.Hash(t.seed)%trackerShards]
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, ok := s.counts[key]; !ok {
+		if len(s.counts) >= s.maxKeys {
+			s.evict()
+		}
+	}
+	s.counts[key]++
+}
+
+// evict forgets the keys with the least count, it must be called with s.mx held.
+func (s *trackerShard[K]) evict() {
+	least := uint64(math.MaxUint64)
+	for _, count := range s.counts {
+		least = min(least, count)
+	}
+
+	for key, count := range s.counts {
+		if count == least {
+			delete(s.counts, key)
+		}
+	}
+}
+
+// hottest returns up to n keys ordered by access count, most accessed first.
+func (t *tracker[K]) hottest(n int) []K {
+	var keys []K
+	var counts []uint64
+	for i := range t.shards {
+		s := &t.shards[i]
+
+		s.mx.Lock()
+		for key, count := range s.counts {
+			keys = append(keys, key)
+			counts = append(counts, count)
+		}
+		s.mx.Unlock()
+	}
+
+	sort.Sort(byCount[K]{keys: keys, counts: counts})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+type byCount[K any] struct {
+	keys   []K
+	counts []uint64
+}
+
+func (b byCount[K]) Len() int           { return len(b.keys) }
+func (b byCount[K]) Less(i, j int) bool { return b.counts[i] > b.counts[j] }
+func (b byCount[K]) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.counts[i], b.counts[j] = b.counts[j], b.counts[i]
+}
+
+// writeKeys stores keys as a sequence of length prefixed marshalled keys, replacing
+// filename only once the whole list is written.
+func writeKeys[K cache.Key[K]](filename string, keys []K) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmpFilename := filename + ".tmp"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		bufWriter := bufio.NewWriter(file)
+		lenBuf := make([]byte, binary.MaxVarintLen64)
+
+		for _, key := range keys {
+			rawByteKey, err := key.Marshal()
+			if err != nil {
+				return err
+			}
+
+			n := binary.PutUvarint(lenBuf, uint64(len(rawByteKey)))
+			_, err = bufWriter.Write(lenBuf[:n])
+			if err != nil {
+				return err
+			}
+			_, err = bufWriter.Write(rawByteKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = bufWriter.Flush()
+		if err != nil {
+			return err
+		}
+		return file.Sync()
+	}()
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFilename)
+	}
+	return err
+}
+
+func readKeys[K cache.Key[K]](filename string) ([]K, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	bufReader := bufio.NewReader(file)
+
+	var (
+		keys []K
+		zero K
+	)
+	for {
+		length, err := binary.ReadUvarint(bufReader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return keys, nil
+			}
+			return nil, err
+		}
+
+		rawByteKey := make([]byte, length)
+		_, err = io.ReadFull(bufReader, rawByteKey)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := zero.Unmarshal(rawByteKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+}
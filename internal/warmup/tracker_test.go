@@ -0,0 +1,62 @@
+package warmup
+
+import (
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/cache"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestTrackerKeepsHotKeysThroughScan(t *testing.T) {
+	const (
+		maxKeys = 1600
+		hotKeys = 50
+	)
+
+	tr := newTracker[cache.Int](maxKeys)
+
+	for round := 0; round < 100; round++ {
+		for key := 0; key < hotKeys; key++ {
+			tr.record(cache.Int(key))
+		}
+	}
+	// A scan of many more keys than the tracker holds, each accessed once.
+	for key := 1_000; key < 1_000+20*maxKeys; key++ {
+		tr.record(cache.Int(key))
+	}
+	// Hot keys seen only after the scan are tracked as well.
+	for round := 0; round < 100; round++ {
+		for key := hotKeys; key < 2*hotKeys; key++ {
+			tr.record(cache.Int(key))
+		}
+	}
+
+	hottest := tr.hottest(2 * hotKeys)
+	for key := 0; key < 2*hotKeys; key++ {
+		if !slices.Contains(hottest, cache.Int(key)) {
+			t.Errorf("hot key %d is not among the hottest keys", key)
+		}
+	}
+}
+
+func TestTrackerConcurrentRecords(t *testing.T) {
+	const goroutines = 8
+
+	tr := newTracker[cache.Int](1000)
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				tr.record(cache.Int(i % 10))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if hottest := tr.hottest(100); len(hottest) != 10 {
+		t.Errorf("tracked %d keys, want 10", len(hottest))
+	}
+}
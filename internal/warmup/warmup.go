@@ -0,0 +1,149 @@
+package warmup
+
+import (
+	"errors"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/cache"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"os"
+	"time"
+)
+
+const (
+	ModeRecent = "recent"
+	ModeHot    = "hot"
+
+	progressInterval = 5 * time.Second
+)
+
+// Warmer preloads the cache after a start so the first requests do not all go to the
+// database. cache.warmup.mode selects the keys: "recent" loads the last cache.warmup.limit
+// inserted keys, "hot" the most accessed keys of the previous run saved to
+// cache.warmup.hot-file, falling back to "recent" without the file. An empty mode
+// disables warm-up. Keys are loaded in batches of cache.warmup.batch-size at no more
+// than cache.warmup.rate keys per second.
+type Warmer[K cache.Key[K], V cache.Codec[V]] struct {
+	cache     *cache.Cache[K, V]
+	recent    func(limit int) ([]K, error)
+	load      func(keys []K) ([]cache.Data[K, V], error)
+	mode      string
+	limit     int
+	batchSize int
+	rate      int
+	hotFile   string
+	tracker   *tracker[K]
+}
+
+func NewWarmer[K cache.Key[K], V cache.Codec[V]](c *cache.Cache[K, V], recent func(limit int) ([]K, error), load func(keys []K) ([]cache.Data[K, V], error)) *Warmer[K, V] {
+	w := &Warmer[K, V]{
+		cache:     c,
+		recent:    recent,
+		load:      load,
+		mode:      viper.GetString("cache.warmup.mode"),
+		limit:     viper.GetInt("cache.warmup.limit"),
+		batchSize: viper.GetInt("cache.warmup.batch-size"),
+		rate:      viper.GetInt("cache.warmup.rate"),
+		hotFile:   viper.GetString("cache.warmup.hot-file"),
+		tracker:   newTracker[K](viper.GetInt("cache.warmup.track-max-keys")),
+	}
+
+	if w.batchSize <= 0 {
+		w.batchSize = 1
+	}
+
+	return w
+}
+
+// Start loads the keys in the background while the service is already serving requests.
+func (w *Warmer[K, V]) Start() {
+	if w.mode == "" || w.limit <= 0 {
+		return
+	}
+
+	go func() {
+		keys, err := w.keys()
+		if err != nil {
+			logrus.Errorf("failed to get keys to warm up cache, error: %v", err)
+			return
+		}
+
+		w.warmUp(keys)
+	}()
+}
+
+func (w *Warmer[K, V]) keys() ([]K, error) {
+	if w.mode == ModeHot {
+		keys, err := readKeys[K](w.hotFile)
+		if err == nil {
+			if len(keys) > w.limit {
+				keys = keys[:w.limit]
+			}
+			return keys, nil
+		}
+
+		if !errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("failed to read hot keys from %s, error: %v", w.hotFile, err)
+		}
+		logrus.Info("no hot keys saved, warming up cache with recent keys")
+	}
+
+	return w.recent(w.limit)
+}
+
+func (w *Warmer[K, V]) warmUp(keys []K) {
+	logrus.Infof("warming up cache with %d keys", len(keys))
+
+	var throttle <-chan time.Time
+	if w.rate > 0 {
+		ticker := time.NewTicker(time.Duration(w.batchSize) * time.Second / time.Duration(w.rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	start := time.Now()
+	lastProgress := start
+	loaded := 0
+
+	for i := 0; i < len(keys); i += w.batchSize {
+		if throttle != nil && i > 0 {
+			<-throttle
+		}
+
+		batch := keys[i:min(i+w.batchSize, len(keys))]
+		readAt := time.Now()
+		data, err := w.load(batch)
+		if err != nil {
+			logrus.Errorf("failed to load keys to warm up cache, error: %v", err)
+			continue
+		}
+
+		w.cache.PutMany(data, readAt)
+		loaded += len(data)
+
+		if time.Since(lastProgress) >= progressInterval {
+			lastProgress = time.Now()
+			logrus.Infof("warming up cache: %d of %d keys processed, %d loaded", i+len(batch), len(keys), loaded)
+		}
+	}
+
+	logrus.Infof("warmed up cache with %d of %d keys in %v", loaded, len(keys), time.Since(start))
+}
+
+// Record counts an access to key for SaveHot, it does nothing unless the mode is "hot".
+// Only keys that exist should be recorded, so requests for missing keys do not take the
+// place of hot keys.
+func (w *Warmer[K, V]) Record(key K) {
+	if w.mode != ModeHot {
+		return
+	}
+	w.tracker.record(key)
+}
+
+// SaveHot saves the most accessed keys of this run for the next warm-up.
+func (w *Warmer[K, V]) SaveHot() error {
+	if w.mode != ModeHot {
+		return nil
+	}
+
+	return writeKeys(w.hotFile, w.tracker.hottest(w.limit))
+}
@@ -1,24 +1,25 @@
 package main
 
 import (
-	"bufio"
-	"compress/gzip"
 	"context"
 	"errors"
-	"fmt"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/backup"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/bloom"
 	"github.com/PrettyPepeBoy/WorkWithNats/internal/cache"
 	"github.com/PrettyPepeBoy/WorkWithNats/internal/endpoint"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/invalidation"
 	"github.com/PrettyPepeBoy/WorkWithNats/internal/objects/product"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/sharding"
+	"github.com/PrettyPepeBoy/WorkWithNats/internal/warmup"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/valyala/fasthttp"
-	"os"
 	"os/signal"
 	"syscall"
-	"time"
 )
 
 var (
@@ -26,6 +27,12 @@ var (
 	productCache   *cache.Cache[cache.Int, cache.ByteSlc]
 	productTable   *product.Table
 	productHandler *product.Handler
+	productBus     *invalidation.Bus[cache.Int, cache.ByteSlc]
+	productGroup   *sharding.Group[cache.Int, cache.ByteSlc]
+	productBackup  *backup.Manager[cache.Int, cache.ByteSlc]
+	productWarmer  *warmup.Warmer[cache.Int, cache.ByteSlc]
+	productIds     *bloom.Guard
+	registry       *prometheus.Registry
 )
 
 func main() {
@@ -34,29 +41,93 @@ func main() {
 	mustInitConfig()
 	mustConnectNats()
 
-	productCache = cache.NewCache[cache.Int, cache.ByteSlc]()
+	registry = prometheus.NewRegistry()
+
+	productCache = cache.NewCache[cache.Int, cache.ByteSlc]("product", registry)
 	productTable, err = product.NewTable()
 	if err != nil {
 		logrus.Fatal(err.Error())
 	}
 
-	httpHandler := endpoint.NewHttpHandler(productCache, productTable)
+	// The id filter is loaded once the invalidation bus and the product handler add new ids,
+	// ids inserted while it is loaded are buffered until then.
+	productIds = bloom.NewGuard()
+
+	productBackup = backup.NewManager(productCache, registry)
+	if viper.GetBool("cache.restore-on-start") && !productCache.Persistent() {
+		_, err = productBackup.Restore()
+		if err != nil {
+			logrus.Errorf("failed to restore cache, error: %v", err)
+		}
+	}
+
+	productWarmer = warmup.NewWarmer(productCache, recentProducts, loadProducts)
+
+	productBus, err = invalidation.NewBus(natsConn, productCache, viper.GetString("nats-server.subjects.product-invalidation"))
+	if err != nil {
+		logrus.Fatalf("failed to create cache invalidation bus, error: %v", err)
+	}
+	// Products inserted by other instances are only known from their invalidations.
+	productBus.OnReceive(func(id cache.Int) {
+		productIds.Add(uint64(id))
+	})
+
+	productGroup, err = sharding.NewGroup(natsConn, productCache, viper.GetString("nats-server.subjects.product-peer"), loadProduct)
+	if err != nil {
+		logrus.Fatalf("failed to create cache sharding group, error: %v", err)
+	}
+
+	httpHandler := endpoint.NewHttpHandler(productCache, productGroup, productTable, productBackup, productWarmer, registry)
 	initProductProcessing()
+	loadProductIds()
+
+	server := &fasthttp.Server{Handler: httpHandler.Handle}
 
 	logrus.Infof("listen server on port: %v", viper.GetString("http-server.port"))
 	go func() {
-		err := fasthttp.ListenAndServe(":"+viper.GetString("http-server.port"), httpHandler.Handle)
+		err := server.ListenAndServe(":" + viper.GetString("http-server.port"))
 		if err != nil {
 			logrus.Fatalf("failed to connect to http server")
 		}
 	}()
 
-	initBackupCache()
+	if !productCache.Persistent() {
+		productBackup.Start()
+	}
+	productWarmer.Start()
 
 	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	<-ctx.Done()
 
 	logrus.Info("stopping server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("http-server.shutdown-timeout"))
+	defer cancel()
+
+	err = server.ShutdownWithContext(shutdownCtx)
+	if err != nil {
+		logrus.Errorf("failed to stop http server, error: %v", err)
+	}
+
+	err = productWarmer.SaveHot()
+	if err != nil {
+		logrus.Errorf("failed to save hot cache keys, error: %v", err)
+	}
+
+	if productCache.Persistent() {
+		err = productCache.Close()
+		if err != nil {
+			logrus.Errorf("failed to close cache file store, error: %v", err)
+		}
+		return
+	}
+
+	res, err := productBackup.Shutdown(shutdownCtx)
+	if err != nil {
+		logrus.Errorf("failed to backup cache on shutdown, error: %v", err)
+		return
+	}
+	logrus.Infof("backed up %d cache records to %s on shutdown", res.Records, res.File)
 }
 
 func mustInitConfig() {
@@ -92,51 +163,91 @@ func initProductProcessing() {
 
 	go func() {
 		for event := range productHandler.C {
-			_, err = productTable.Put(event.Name, event.Data)
+			id, version, err := productTable.Put(event.Name, event.Data)
 			if err != nil {
 				logrus.Errorf("failed to put in table, error: %v", err)
+				continue
+			}
+
+			productIds.Add(uint64(id))
+
+			err = productBus.Invalidate(cache.Int(id))
+			if err != nil {
+				logrus.Errorf("failed to publish cache invalidation, error: %v", err)
 			}
+
+			productCache.PutIfNewer(cache.Int(id), event.Data, uint64(version))
 		}
 	}()
 
 }
 
-func initBackupCache() {
-	t := viper.GetDuration("cache.backup_interval")
+// loadProductIds loads the ids in the table into productIds, sized for product.id-filter.capacity
+// ids or twice the current amount if that is more. If loading fails every id is loaded from the table.
+func loadProductIds() {
+	n, err := productIds.Load(func() ([]uint64, error) {
+		ids, err := productTable.GetAllIds()
+		if err != nil {
+			return nil, err
+		}
 
-	go func() {
-		for {
-			time.Sleep(t)
+		keys := make([]uint64, len(ids))
+		for i, id := range ids {
+			keys[i] = uint64(id)
+		}
+		return keys, nil
+	}, viper.GetInt("product.id-filter.capacity"), viper.GetFloat64("product.id-filter.false-positive-rate"))
+	if err != nil {
+		logrus.Errorf("failed to load product id filter, loading every id from the table, error: %v", err)
+		return
+	}
 
-			filename := fmt.Sprintf("/var/lib/cache/data/cache_data_%v.gz", time.Now().UnixNano())
+	logrus.Infof("loaded %d product ids into the id filter", n)
+}
 
-			file, err := os.Create(filename)
-			if err != nil {
-				logrus.Errorf("failed to create gzip file for backup, error: %v", err)
-				return
-			}
+// loadProduct reports ids missing from productIds as not found without querying the table.
+func loadProduct(id cache.Int) (cache.ByteSlc, error) {
+	if !productIds.MayContain(uint64(id)) {
+		return nil, cache.ErrNotFound
+	}
 
-			gzipWriter := gzip.NewWriter(file)
-			bufWriter := bufio.NewWriter(gzipWriter)
-			productCache.GetAllRawData(bufWriter)
+	data, err := productTable.GetById(int(id))
+	if err != nil {
+		if errors.Is(err, product.ErrRowNotExist) {
+			return nil, cache.ErrNotFound
+		}
+		return nil, err
+	}
+	return data, nil
+}
 
-			err = bufWriter.Flush()
-			if err != nil {
-				logrus.Errorf("failed to flush buffer, error: %v", err)
-				_ = file.Close()
-				_ = os.Remove(filename)
-				continue
-			}
+func recentProducts(limit int) ([]cache.Int, error) {
+	ids, err := productTable.GetRecentIds(limit)
+	if err != nil {
+		return nil, err
+	}
 
-			err = gzipWriter.Close()
-			if err != nil {
-				logrus.Errorf("failed to close gzipWriter, error: %v", err)
-				_ = file.Close()
-				_ = os.Remove(filename)
-				continue
-			}
+	keys := make([]cache.Int, len(ids))
+	for i, id := range ids {
+		keys[i] = cache.Int(id)
+	}
+	return keys, nil
+}
 
-			_ = file.Close()
-		}
-	}()
+func loadProducts(keys []cache.Int) ([]cache.Data[cache.Int, cache.ByteSlc], error) {
+	ids := make([]int, len(keys))
+	for i, key := range keys {
+		ids[i] = int(key)
+	}
+
+	rows, err := productTable.GetByIds(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]cache.Data[cache.Int, cache.ByteSlc], len(rows))
+	for i, row := range rows {
+		data[i] = cache.Data[cache.Int, cache.ByteSlc]{Key: cache.Int(row.Id), Value: row.Data}
+	}
+	return data, nil
 }
@@ -21,8 +21,8 @@ func (e *Element[K]) Prev() *Element[K] {
 }
 
 type List[K comparable] struct {
-	root       Element[K]
-	lastInsert *Element[K]
+	root Element[K]
+	len  int
 }
 
 func NewList[K comparable]() *List[K] {
@@ -33,50 +33,58 @@ func (l *List[K]) init() *List[K] {
 	l.root.prev = &l.root
 	l.root.next = &l.root
 	l.root.list = l
-	l.lastInsert = &l.root
+	l.len = 0
 	return l
 }
 
+// Put inserts e at the back of the list.
 func (l *List[K]) Put(e *Element[K]) *Element[K] {
-	e.list = l
-	e.prev = l.lastInsert
-	e.prev.next = e
-	l.lastInsert = e
+	l.insert(e, l.root.prev)
 	return e
 }
 
+func (l *List[K]) insert(e, at *Element[K]) {
+	e.list = l
+	e.prev = at
+	e.next = at.next
+	at.next.prev = e
+	at.next = e
+	l.len++
+}
+
 func (l *List[K]) Remove(e *Element[K]) {
-	e.prev.next = e.next
-	if e.next != nil {
-		e.next.prev = e.prev
+	if e.list != l {
+		return
 	}
 
-	if l.lastInsert.Value == e.Value {
-		l.lastInsert = e.prev
-	}
+	e.prev.next = e.next
+	e.next.prev = e.prev
 
 	e.next = nil
 	e.prev = nil
 	e.list = nil
+	l.len--
 }
 
-func (l *List[K]) RemoveFront(e *Element[K]) {
-	e.prev = &l.root
-	e.prev.next = e
+// MoveToBack moves e to the back of the list, e must belong to l.
+func (l *List[K]) MoveToBack(e *Element[K]) {
+	if e.list != l || l.root.prev == e {
+		return
+	}
+
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	l.len--
+	l.insert(e, l.root.prev)
 }
 
 func (l *List[K]) Front() *Element[K] {
-	if l == nil {
+	if l == nil || l.len == 0 {
 		return nil
 	}
 	return l.root.next
 }
 
-func (l *List[K]) findElem(v K) *Element[K] {
-	for e := l.Front(); e != nil; e = e.Next() {
-		if e.Value == v {
-			return e
-		}
-	}
-	return nil
+func (l *List[K]) Len() int {
+	return l.len
 }
@@ -0,0 +1,2 @@
+alter table products drop column version;
+drop sequence products_version_seq;
\ No newline at end of file
@@ -0,0 +1,4 @@
+create sequence if not exists products_version_seq;
+
+alter table products
+    add column if not exists version bigint not null default nextval('products_version_seq');
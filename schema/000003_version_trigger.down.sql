@@ -0,0 +1,2 @@
+drop trigger if exists products_next_version on products;
+drop function if exists products_next_version();
\ No newline at end of file
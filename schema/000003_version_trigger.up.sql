@@ -0,0 +1,13 @@
+create or replace function products_next_version() returns trigger as
+$$
+begin
+    new.version := nextval('products_version_seq');
+    return new;
+end;
+$$ language plpgsql;
+
+create trigger products_next_version
+    before update
+    on products
+    for each row
+execute function products_next_version();
\ No newline at end of file